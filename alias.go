@@ -0,0 +1,82 @@
+package s3
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/go-ini/ini"
+)
+
+// bucketAlias is a short name for a bucket and base prefix, and the
+// profile or endpoint to reach it, used as s3://name/.
+type bucketAlias struct {
+	bucket   string
+	prefix   string
+	settings connSettings
+}
+
+// aliases are the [alias NAME] sections of the s3 config file.
+var aliases map[string]*bucketAlias
+
+// loadAliases reads the aliases from the s3 config file.
+func loadAliases() error {
+	aliases = map[string]*bucketAlias{}
+	filename := configFile()
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	f, err := ini.Load(filename)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	for _, section := range f.Sections() {
+		if !strings.HasPrefix(section.Name(), "alias ") {
+			continue
+		}
+		name := strings.TrimSpace(strings.TrimPrefix(section.Name(), "alias "))
+		alias := &bucketAlias{
+			bucket: section.Key("bucket").String(),
+			prefix: strings.Trim(section.Key("prefix").String(), "/"),
+			settings: connSettings{
+				profile:  section.Key("profile").String(),
+				endpoint: section.Key("endpoint").String(),
+				region:   section.Key("region").String(),
+			},
+		}
+		if alias.bucket == "" {
+			return fmt.Errorf("%s: alias %s: bucket is required", filename, name)
+		}
+		aliases[name] = alias
+	}
+	return nil
+}
+
+// resolveAlias maps the bucket and path of an aliased url to the real
+// bucket and path.
+func resolveAlias(bucket, key string) (string, string) {
+	alias := aliases[bucket]
+	if alias == nil {
+		return bucket, key
+	}
+	if alias.prefix != "" {
+		key = alias.prefix + "/" + key
+	}
+	return alias.bucket, key
+}
+
+// bucketConnection returns the connection for the bucket of url and its
+// settings, which may differ from conn and settings for an alias with its
+// own profile or endpoint, or for a bucket in another region.
+func bucketConnection(conn s3iface.S3API, settings connSettings, url string) (s3iface.S3API, connSettings) {
+	parts := reBucketPath.FindStringSubmatch(url)
+	if alias := aliases[parts[1]]; alias != nil && alias.settings != (connSettings{}) {
+		settings = alias.settings
+	}
+	if settings != (connSettings{}) {
+		conn = connect(settings)
+	}
+	bucket, _ := resolveAlias(parts[1], parts[2])
+	return regionConnection(conn, settings, bucket), settings
+}
@@ -0,0 +1,49 @@
+package s3
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// backups receives the previous version of files overwritten or deleted by
+// a sync, if --backup-prefix is given.
+var backups Filesystem
+
+func backupFilesystem(conn s3iface.S3API) Filesystem {
+	if backupPrefix == "" {
+		return nil
+	}
+	prefix := backupPrefix
+	if isS3Url(prefix) && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	// backups are written alongside the destination, with its account
+	return sideFilesystem(conn, destSettings, prefix)
+}
+
+// backup copies the destination file an action will overwrite or delete to
+// the backups.
+func backup(action Action, fs2 Filesystem) error {
+	if backups == nil {
+		return nil
+	}
+	old := action.File
+	if action.Action != "delete" {
+		// the action's file is the source, so find the destination file
+		old = nil
+		relpath := action.File.Relative()
+		for file := range fs2.FilesUnder(relpath) {
+			if file.Relative() == relpath {
+				old = file
+			}
+		}
+		if err := fs2.Error(); err != nil {
+			return err
+		}
+		if old == nil {
+			return nil
+		}
+	}
+	return backups.Create(old)
+}
@@ -0,0 +1,151 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadLimit and downloadLimit are shared by all transfers, so limits hold
+// however many run in parallel.
+var uploadLimit, downloadLimit *rateLimiter
+
+// clock tells the time for rate limiters, and is replaced in tests.
+var clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+} = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// rateLimiter is a token bucket limiting bytes per second, allowing bursts
+// of up to a second.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	// specific is set when limited by --bwlimit-up or --bwlimit-down,
+	// which take precedence over --bwlimit
+	specific bool
+}
+
+// wait blocks until n bytes may be transferred.
+func (self *rateLimiter) wait(n int) {
+	if self.rate == 0 {
+		return
+	}
+	self.Lock()
+	now := clock.Now()
+	if self.last.IsZero() {
+		self.tokens = self.rate
+	} else {
+		self.tokens += now.Sub(self.last).Seconds() * self.rate
+		if self.tokens > self.rate {
+			self.tokens = self.rate
+		}
+	}
+	self.last = now
+	// take the tokens now, so later callers queue behind
+	self.tokens -= float64(n)
+	delay := time.Duration(-self.tokens / self.rate * float64(time.Second))
+	self.Unlock()
+	if delay > 0 {
+		clock.Sleep(delay)
+	}
+}
+
+// limitChunk is the most read at once, keeping waits short.
+const limitChunk = 32 * 1024
+
+type limitedReader struct {
+	io.ReadCloser
+	limiter *rateLimiter
+}
+
+func (self *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+	n, err := self.ReadCloser.Read(p)
+	self.limiter.wait(n)
+	return n, err
+}
+
+// readSeeker seeks the reader that was wrapped, so skipping parts of an
+// upload isn't counted as transferring them.
+type readSeeker struct {
+	io.ReadCloser
+	seeker io.Seeker
+}
+
+func (self readSeeker) Seek(offset int64, whence int) (int64, error) {
+	return self.seeker.Seek(offset, whence)
+}
+
+// keepSeeker returns wrapped, seekable if reader is.
+func keepSeeker(reader, wrapped io.ReadCloser) io.ReadCloser {
+	if s, ok := reader.(io.Seeker); ok {
+		return readSeeker{wrapped, s}
+	}
+	return wrapped
+}
+
+// limit wraps reader to transfer no faster than limiter allows.
+func limit(reader io.ReadCloser, limiter *rateLimiter) io.ReadCloser {
+	if limiter.rate == 0 {
+		return reader
+	}
+	return keepSeeker(reader, &limitedReader{reader, limiter})
+}
+
+// parseRate parses a rate in bytes per second, with an optional K, M, G or
+// T suffix.
+func parseRate(value string) (float64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(value), "B")
+	multiplier := 1.0
+	if i := strings.IndexAny(s, "KMGT"); i != -1 && i == len(s)-1 {
+		multiplier = map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}[s[i]]
+		s = s[:i]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate: %s", value)
+	}
+	return n * multiplier, nil
+}
+
+// rateFlag is a cli.Generic setting the rate of limiters.
+type rateFlag struct {
+	limiters []*rateLimiter
+	specific bool
+}
+
+func (self *rateFlag) Set(value string) error {
+	rate, err := parseRate(value)
+	if err != nil {
+		return err
+	}
+	for _, limiter := range self.limiters {
+		if self.specific || !limiter.specific {
+			limiter.rate = rate
+			limiter.specific = self.specific
+		}
+	}
+	return nil
+}
+
+func (self *rateFlag) String() string {
+	return ""
+}
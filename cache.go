@@ -0,0 +1,221 @@
+package s3
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// checksums is the cache in use for the current command, if enabled.
+var checksums *checksumCache
+
+// checksumCache persists md5s of local files between runs, so unchanged
+// files need only be stat'd. An entry is keyed by absolute path and only
+// valid while size, mtime and inode match.
+type checksumCache struct {
+	sync.Mutex
+	path    string
+	entries map[string]checksumEntry
+	dirty   bool
+	// the files seen and the directories fully walked, for pruning
+	seen   map[string]bool
+	walked []string
+}
+
+type checksumEntry struct {
+	size  int64
+	mtime int64
+	inode uint64
+	md5   []byte
+}
+
+func newChecksumEntry(info os.FileInfo, sum []byte) checksumEntry {
+	return checksumEntry{info.Size(), info.ModTime().UnixNano(), inode(info), sum}
+}
+
+func loadChecksumCache(path string) (*checksumCache, error) {
+	cache := &checksumCache{path: path, entries: map[string]checksumEntry{}, seen: map[string]bool{}}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// each line is: md5 size mtime inode "path"
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 5)
+		if len(fields) != 5 {
+			continue
+		}
+		var entry checksumEntry
+		var err1, err2, err3, err4, err5 error
+		entry.md5, err1 = hex.DecodeString(fields[0])
+		entry.size, err2 = strconv.ParseInt(fields[1], 10, 64)
+		entry.mtime, err3 = strconv.ParseInt(fields[2], 10, 64)
+		entry.inode, err4 = strconv.ParseUint(fields[3], 10, 64)
+		key, err5 := strconv.Unquote(fields[4])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil {
+			// skip corrupt entries
+			continue
+		}
+		cache.entries[key] = entry
+	}
+	return cache, scanner.Err()
+}
+
+func (self *checksumCache) Get(path string, info os.FileInfo) []byte {
+	if self == nil {
+		return nil
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	self.Lock()
+	defer self.Unlock()
+	entry, ok := self.entries[key]
+	if !ok {
+		return nil
+	}
+	current := newChecksumEntry(info, nil)
+	if entry.size != current.size || entry.mtime != current.mtime || entry.inode != current.inode {
+		return nil
+	}
+	return entry.md5
+}
+
+func (self *checksumCache) Put(path string, info os.FileInfo, sum []byte) {
+	if self == nil {
+		return
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.entries[key] = newChecksumEntry(info, sum)
+	self.dirty = true
+}
+
+// Seen records a file found walking a directory, dropping its entry if the
+// file has changed since.
+func (self *checksumCache) Seen(path string, info os.FileInfo) {
+	if self == nil {
+		return
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.seen[key] = true
+	entry, ok := self.entries[key]
+	if !ok {
+		return
+	}
+	current := newChecksumEntry(info, nil)
+	if entry.size != current.size || entry.mtime != current.mtime || entry.inode != current.inode {
+		delete(self.entries, key)
+		self.dirty = true
+	}
+}
+
+// Walked records that every file under path has been seen.
+func (self *checksumCache) Walked(path string) {
+	if self == nil {
+		return
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.walked = append(self.walked, key)
+}
+
+// prune drops the entries for files no longer under the directories walked.
+// Entries elsewhere, perhaps from syncing other directories, are kept.
+func (self *checksumCache) prune() {
+	for key := range self.entries {
+		if self.seen[key] {
+			continue
+		}
+		for _, dir := range self.walked {
+			if key == dir || strings.HasPrefix(key, dir+string(filepath.Separator)) {
+				delete(self.entries, key)
+				self.dirty = true
+				break
+			}
+		}
+	}
+}
+
+// Save writes the cache if changed, replacing the previous file atomically.
+func (self *checksumCache) Save() error {
+	self.Lock()
+	defer self.Unlock()
+	self.prune()
+	if !self.dirty {
+		return nil
+	}
+	dir := filepath.Dir(self.path)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, ".checksums")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	writer := bufio.NewWriter(file)
+	for key, entry := range self.entries {
+		fmt.Fprintf(writer, "%x %d %d %d %s\n", entry.md5, entry.size, entry.mtime, entry.inode, strconv.Quote(key))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(file.Name(), self.path)
+	if err == nil {
+		self.dirty = false
+	}
+	return err
+}
+
+// withChecksumCache runs fn with the checksum cache loaded, if enabled,
+// saving any new entries afterwards.
+func withChecksumCache(fn func() error) error {
+	if checksumCachePath == "" {
+		return fn()
+	}
+	cache, err := loadChecksumCache(checksumCachePath)
+	if err != nil {
+		return err
+	}
+	checksums = cache
+	defer func() { checksums = nil }()
+	err = fn()
+	if e := cache.Save(); err == nil {
+		err = e
+	}
+	return err
+}
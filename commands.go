@@ -18,6 +18,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -29,13 +30,18 @@ var reBucketPath = regexp.MustCompile("^(?:s3://)?([^/]+)/?(.*)$")
 var out io.Writer = os.Stdout
 var err io.Writer = os.Stderr
 
+// warn reports a problem that doesn't stop the command.
+func warn(format string, args ...interface{}) {
+	fmt.Fprintf(err, "Warning: "+format+"\n", args...)
+}
+
 var (
 	ErrNotFound = errors.New("No files found")
 )
 
 func extractBucketPath(url string) (string, string) {
 	parts := reBucketPath.FindStringSubmatch(url)
-	return parts[1], parts[2]
+	return resolveAlias(parts[1], parts[2])
 }
 
 func listBuckets(conn s3iface.S3API) error {
@@ -44,7 +50,11 @@ func listBuckets(conn s3iface.S3API) error {
 		return err
 	}
 	for _, b := range output.Buckets {
-		fmt.Fprintf(out, "s3://%s/\n", *b.Name)
+		if structured() {
+			emit(bucketRecord{*b.Name})
+		} else {
+			fmt.Fprintf(out, "s3://%s/\n", *b.Name)
+		}
 	}
 	return nil
 }
@@ -53,7 +63,7 @@ func iterateKeys(conn s3iface.S3API, urls []string, callback func(file File) err
 	found := false
 	for _, url := range urls {
 		fs := getFilesystem(conn, url)
-		ch := fs.Files()
+		ch := filterFiles(fs.Files())
 		for file := range ch {
 			found = true
 			err := callback(file)
@@ -76,12 +86,17 @@ func iterateKeysParallel(conn s3iface.S3API, urls []string, callback func(file F
 	var err error
 	wg := sync.WaitGroup{}
 	q := make(chan File, 1000)
+	limit, stop := startConcurrency()
+	defer stop()
 	for i := 0; i < parallel; i += 1 {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for key := range q {
+				limit.acquire()
 				e := callback(key)
+				limit.release()
+				progress.done()
 				if e != nil {
 					err = e
 					return
@@ -91,12 +106,14 @@ func iterateKeysParallel(conn s3iface.S3API, urls []string, callback func(file F
 	}
 
 	e := iterateKeys(conn, urls, func(file File) error {
+		progress.add(file.Size())
 		q <- file
 		return nil
 	})
 	if e != nil {
 		return e
 	}
+	progress.complete()
 
 	close(q)
 	wg.Wait()
@@ -106,7 +123,9 @@ func iterateKeysParallel(conn s3iface.S3API, urls []string, callback func(file F
 func listKeys(conn s3iface.S3API, urls []string) error {
 	var count, totalSize int64
 	err := iterateKeys(conn, urls, func(file File) error {
-		if quiet {
+		if structured() {
+			emit(newKeyRecord(file))
+		} else if quiet {
 			fmt.Fprintln(out, file)
 		} else {
 			fmt.Fprintf(out, "%s\t%db\n", file, file.Size())
@@ -118,7 +137,9 @@ func listKeys(conn s3iface.S3API, urls []string) error {
 	if err != nil && err != ErrNotFound {
 		return err
 	}
-	if !quiet {
+	if structured() {
+		emit(summaryRecord{listSummary{count, totalSize}})
+	} else if !quiet {
 		fmt.Fprintf(out, "\n%d files, %d bytes\n", count, totalSize)
 	}
 	return nil
@@ -131,6 +152,8 @@ func getKeys(conn s3iface.S3API, urls []string) error {
 		}
 	}
 
+	tracker := startProgress()
+	defer tracker.Stop()
 	err := iterateKeysParallel(conn, urls, func(file File) error {
 		reader, err := file.Reader()
 		if err != nil {
@@ -140,23 +163,20 @@ func getKeys(conn s3iface.S3API, urls []string) error {
 
 		// write files under relative path to the source path
 		fpath := file.Relative()
-		dirpath := path.Dir(fpath)
-		if dirpath != "." {
-			err = os.MkdirAll(dirpath, 0777)
-			if err != nil {
-				return err
-			}
-		}
-
-		writer, err := os.Create(fpath)
+		link, err := createLink(".", fpath, file)
 		if err != nil {
 			return err
 		}
-		nbytes, err := io.Copy(writer, reader)
-		if err != nil {
-			return err
+		var nbytes int64
+		if !link {
+			nbytes, err = writeFile(fpath, file, reader)
+			if err != nil {
+				return err
+			}
 		}
-		if !quiet {
+		if structured() {
+			emit(newActionRecord("get", file.String(), nbytes, nil))
+		} else if !quiet {
 			fmt.Fprintf(out, "%s -> %s (%d bytes)\n", file, fpath, nbytes)
 		}
 		return nil
@@ -164,6 +184,32 @@ func getKeys(conn s3iface.S3API, urls []string) error {
 	return err
 }
 
+// writeFile writes the contents of a downloaded file to fpath.
+func writeFile(fpath string, file File, reader io.ReadCloser) (int64, error) {
+	err := linksCreated.checkWrite(fpath)
+	if err != nil {
+		return 0, err
+	}
+	dirpath := path.Dir(fpath)
+	if dirpath != "." {
+		err := os.MkdirAll(dirpath, 0777)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	writer, err := os.Create(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer writer.Close()
+	nbytes, err := io.Copy(writer, progress.reader(reader))
+	if err != nil {
+		return nbytes, err
+	}
+	return nbytes, restoreAttributes(fpath, file)
+}
+
 func catKeys(conn s3iface.S3API, urls []string) error {
 	return iterateKeysParallel(conn, urls, func(file File) error {
 		reader, err := file.Reader()
@@ -187,7 +233,7 @@ func catKeys(conn s3iface.S3API, urls []string) error {
 	})
 }
 
-func outputMatches(buf []byte, needle []byte, prefix string) {
+func outputMatches(buf []byte, needle []byte, key, prefix string) {
 	p := 0
 	for {
 		i := bytes.Index(buf[p:], needle)
@@ -209,7 +255,11 @@ func outputMatches(buf []byte, needle []byte, prefix string) {
 		}
 		line := string(buf[lineStart:lineEnd])
 
-		fmt.Fprintf(out, "%s%s\n", prefix, line)
+		if structured() {
+			emit(matchRecord{Key: key, Line: line})
+		} else {
+			fmt.Fprintf(out, "%s%s\n", prefix, line)
+		}
 
 		p = lineEnd + 1
 		if p > len(buf)-len(needle) {
@@ -242,14 +292,20 @@ func grepKeys(conn s3iface.S3API, find string, urls []string, noKeysPrefix bool,
 
 		buf := make([]byte, 4096)
 		offset := 0
-		for n, err := reader.Read(buf[offset:]); n > 0 && err == nil; n, err = reader.Read(buf[offset:]) {
+		// the last bytes may be read along with io.EOF
+		var n int
+		for n, err = reader.Read(buf[offset:]); n > 0; n, err = reader.Read(buf[offset:]) {
 			if bytes.Contains(buf[:n+offset], needle) {
 				if keysWithMatches {
 					// only filename required, bail early
-					fmt.Fprintln(out, file.String())
+					if structured() {
+						emit(matchRecord{Key: file.String()})
+					} else {
+						fmt.Fprintln(out, file.String())
+					}
 					break
 				} else {
-					outputMatches(buf[:n+offset], needle, prefix)
+					outputMatches(buf[:n+offset], needle, file.String(), prefix)
 				}
 			}
 			// handle overlapping matches - copy last N-1 bytes to start of next
@@ -259,6 +315,9 @@ func grepKeys(conn s3iface.S3API, find string, urls []string, noKeysPrefix bool,
 			} else {
 				copy(buf, buf[n-offset:])
 			}
+			if err != nil {
+				break
+			}
 		}
 		if err != nil && err != io.EOF {
 			return err
@@ -267,7 +326,10 @@ func grepKeys(conn s3iface.S3API, find string, urls []string, noKeysPrefix bool,
 	})
 }
 
-func deleteBatch(conn s3iface.S3API, bucket string, batch []*s3.ObjectIdentifier) error {
+// deleteBatch deletes keys in bucket, returning the error for any key
+// that couldn't be deleted.
+func deleteBatch(conn s3iface.S3API, bucket string, batch []*s3.ObjectIdentifier) (map[string]error, error) {
+	errs := map[string]error{}
 	if !dryRun {
 		deleteRequest := s3.Delete{
 			Objects: batch,
@@ -276,10 +338,15 @@ func deleteBatch(conn s3iface.S3API, bucket string, batch []*s3.ObjectIdentifier
 			Bucket: aws.String(bucket),
 			Delete: &deleteRequest,
 		}
-		_, err := conn.DeleteObjects(&input)
-		return err
+		output, err := conn.DeleteObjects(&input)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range output.Errors {
+			errs[aws.StringValue(e.Key)] = fmt.Errorf("%s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message))
+		}
 	}
-	return nil
+	return errs, nil
 }
 
 func rmKeys(conn s3iface.S3API, urls []string) error {
@@ -287,56 +354,130 @@ func rmKeys(conn s3iface.S3API, urls []string) error {
 		if !isS3Url(url) {
 			return errors.New("Cowardly refusing to remove local files. Use rm.")
 		}
+		bucket, prefix := extractBucketPath(url)
+		if prefix == "" && !force {
+			return fmt.Errorf("Refusing to remove everything in bucket %s without --force", bucket)
+		}
 	}
 	batch := make([]*s3.ObjectIdentifier, 0, 1000)
+	var batchFiles []File
 	var bucket string
+	var bucketConn s3iface.S3API
 	start := time.Now()
-	var deleted int
-	err := iterateKeys(conn, urls, func(file File) error {
-		deleted += 1
+	var counts syncCounts
+	report := func(file File, err error) {
+		if structured() {
+			emit(newActionRecord("delete", file.String(), file.Size(), err))
+		} else if err != nil {
+			fmt.Fprintf(out, "E %s: %s\n", file, err)
+		}
+		if err != nil {
+			counts.failed += 1
+		}
+	}
+	flush := func() {
+		errs, err := deleteBatch(bucketConn, bucket, batch)
+		for _, file := range batchFiles {
+			if err == nil {
+				report(file, errs[*file.(*S3File).object.Key])
+			} else {
+				report(file, err)
+			}
+		}
+		batch = batch[:0]
+		batchFiles = batchFiles[:0]
+	}
+	remove := func(file File) error {
+		counts.deleted += 1
 		if !quiet {
 			fmt.Fprintf(out, "D %s\n", file)
 		}
 		switch t := file.(type) {
 		case *S3File:
 			// optimize as a batch delete
-			if t.bucket != bucket && len(batch) > 0 {
-				deleteBatch(conn, bucket, batch)
-				batch = batch[:0]
+			if (t.bucket != bucket || t.conn != bucketConn) && len(batch) > 0 {
+				flush()
 			}
-			bucket = t.bucket
+			bucket, bucketConn = t.bucket, t.conn
 			obj := s3.ObjectIdentifier{Key: t.object.Key}
 			batch = append(batch, &obj)
+			batchFiles = append(batchFiles, file)
 			if len(batch) == 1000 {
-				deleteBatch(conn, bucket, batch)
-				batch = batch[:0]
+				flush()
 			}
 
 		default:
+			var err error
 			if !dryRun {
-				file.Delete()
+				err = file.Delete()
 			}
+			report(file, err)
 		}
 		return nil
-	})
+	}
+
+	var err error
+	if deleteLimited() {
+		// list everything first to check the limits before deleting
+		var files []File
+		err = iterateKeys(conn, urls, func(file File) error {
+			files = append(files, file)
+			return nil
+		})
+		total := len(files)
+		if err == nil && maxDeletePercent < 100 {
+			total, err = bucketFiles(conn, urls)
+		}
+		if err == nil {
+			err = checkDeletes(len(files), total)
+		}
+		for i := 0; i < len(files) && err == nil; i++ {
+			err = remove(files[i])
+		}
+	} else {
+		err = iterateKeys(conn, urls, remove)
+	}
 	if err != nil {
 		return err
 	}
 
 	// final batch
 	if len(batch) > 0 {
-		deleteBatch(conn, bucket, batch)
+		flush()
 	}
 	end := time.Now()
 	took := end.Sub(start)
-	summary(0, deleted, 0, 0, took)
-	return nil
+	summary(counts, took)
+	return counts.failures()
+}
+
+// bucketFiles counts the files in the buckets (or aliases) of urls, which
+// --max-delete-percent is a percentage of for rm.
+func bucketFiles(conn s3iface.S3API, urls []string) (int, error) {
+	seen := map[string]bool{}
+	total := 0
+	for _, url := range urls {
+		root := "s3://" + reBucketPath.FindStringSubmatch(url)[1] + "/"
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+		fs := getFilesystem(conn, root)
+		for range fs.Files() {
+			total += 1
+		}
+		if err := fs.Error(); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
 }
 
 func rmBuckets(conn s3iface.S3API, buckets []string) error {
 	for _, name := range buckets {
 		bucket, _ := extractBucketPath(name)
 		input := s3.DeleteBucketInput{Bucket: aws.String(bucket)}
+		conn, _ := bucketConnection(conn, connSettings{}, name)
 		_, err := conn.DeleteBucket(&input)
 		if err != nil {
 			return err
@@ -345,18 +486,35 @@ func rmBuckets(conn s3iface.S3API, buckets []string) error {
 	return nil
 }
 
-func summary(added, deleted, updated, unchanged int, took time.Duration) {
-	rate := float64(added+deleted+updated) / took.Seconds()
+func summary(counts syncCounts, took time.Duration) {
+	if structured() {
+		emit(summaryRecord{syncSummary{
+			Added:     counts.added,
+			Deleted:   counts.deleted,
+			Updated:   counts.updated,
+			Unchanged: counts.unchanged,
+			Failed:    counts.failed,
+			Bytes:     counts.bytes,
+			Seconds:   took.Seconds(),
+			DryRun:    dryRun,
+		}})
+		return
+	}
+	rate := float64(counts.added+counts.deleted+counts.updated) / took.Seconds()
 
 	if dryRun {
 		fmt.Fprintln(out, "-- summary (dry-run) --")
 	} else {
 		fmt.Fprintln(out, "-- summary --")
 	}
-	fmt.Fprintf(out, `%d added %d deleted %d updated %d unchanged
+	fmt.Fprintf(out, `%d added %d deleted %d updated %d unchanged %d failed
 took: %s (%.1f ops/s)
-
-`, added, deleted, updated, unchanged, took, rate)
+`, counts.added, counts.deleted, counts.updated, counts.unchanged, counts.failed, took, rate)
+	if !dryRun && counts.added+counts.updated > 0 {
+		bandwidth := float64(counts.bytes) / took.Seconds()
+		fmt.Fprintf(out, "transferred: %s (%s/s)\n", formatBytes(float64(counts.bytes)), formatBytes(bandwidth))
+	}
+	fmt.Fprintln(out)
 }
 
 func putBuckets(conn s3iface.S3API, buckets []string) error {
@@ -380,17 +538,16 @@ func putKeys(conn s3iface.S3API, sources []string, destination string) error {
 	}
 	dfs := getFilesystem(conn, destination)
 	var added int
+	tracker := startProgress()
+	defer tracker.Stop()
 	err := iterateKeysParallel(conn, sources, func(file File) error {
-		reader, err := file.Reader()
-		if err != nil {
-			return err
-		}
-		defer reader.Close()
-
 		if !quiet {
 			fmt.Fprintf(out, "A %s\n", file)
 		}
-		err = dfs.Create(file)
+		err := dfs.Create(file)
+		if structured() {
+			emit(newActionRecord("create", file.String(), file.Size(), err))
+		}
 		if err != nil {
 			return err
 		}
@@ -400,9 +557,10 @@ func putKeys(conn s3iface.S3API, sources []string, destination string) error {
 	if err != nil {
 		return err
 	}
+	tracker.Stop()
 	end := time.Now()
 	took := end.Sub(start)
-	summary(added, 0, 0, 0, took)
+	summary(syncCounts{added: added, bytes: tracker.Transferred()}, took)
 
 	return nil
 }
@@ -412,19 +570,33 @@ func isS3Url(url string) bool {
 }
 
 func getFilesystem(conn s3iface.S3API, url string) Filesystem {
+	return sideFilesystem(conn, connSettings{}, url)
+}
+
+// sideFilesystem returns the filesystem for url connecting with settings,
+// such as for one side of a sync, rather than with conn if set.
+func sideFilesystem(conn s3iface.S3API, settings connSettings, url string) Filesystem {
 	if isS3Url(url) {
 		bucket, prefix := extractBucketPath(url)
-		return &S3Filesystem{conn: conn, bucket: bucket, path: prefix}
+		conn, settings = bucketConnection(conn, settings, url)
+		return &S3Filesystem{conn: conn, settings: settings, bucket: bucket, path: prefix}
 	} else {
-		return &LocalFilesystem{path: url}
+		return &LocalFilesystem{path: url, cache: checksums}
 	}
 }
 
 type Action struct {
 	Action string
 	File   File
+	Reason string
 }
 
+// reasons for creating and deleting files
+const (
+	destMissing = "missing"
+	srcMissing  = "extra"
+)
+
 func processAction(action Action, fs2 Filesystem) error {
 	switch action.Action {
 	case "create":
@@ -436,11 +608,7 @@ func processAction(action Action, fs2 Filesystem) error {
 		}
 		err := fs2.Create(action.File)
 		if err != nil {
-			if ignoreErrors {
-				fmt.Fprintf(out, "E %s: %s\n", action.File.Relative(), err)
-			} else {
-				return err
-			}
+			return err
 		}
 	case "delete":
 		if !quiet {
@@ -449,7 +617,11 @@ func processAction(action Action, fs2 Filesystem) error {
 		if dryRun {
 			return nil
 		}
-		err := fs2.Delete(action.File.Relative())
+		err := backup(action, fs2)
+		if err != nil {
+			return err
+		}
+		err = fs2.Delete(action.File.Relative())
 		if err != nil {
 			return err
 		}
@@ -460,38 +632,105 @@ func processAction(action Action, fs2 Filesystem) error {
 		if dryRun {
 			return nil
 		}
-		err := fs2.Create(action.File)
+		err := backup(action, fs2)
+		if err != nil {
+			return err
+		}
+		err = fs2.Create(action.File)
 		if err != nil {
 			return err
 		}
 	}
+	return journal.Done(action)
+}
+
+type syncCounts struct {
+	added, deleted, updated, unchanged, failed int
+	// bytes transferred
+	bytes int64
+}
+
+// failures returns an error if any actions failed, unless ignoring errors.
+func (self syncCounts) failures() error {
+	if self.failed > 0 && !ignoreErrors {
+		return fmt.Errorf("%d failed", self.failed)
+	}
+	return nil
+}
+
+// deleteLimited returns whether --max-delete or --max-delete-percent are
+// given.
+func deleteLimited() bool {
+	return maxDelete >= 0 || maxDeletePercent < 100
+}
+
+// checkDeletes returns an error if deleting n of total files crosses the
+// delete limits.
+func checkDeletes(n, total int) error {
+	if maxDelete >= 0 && n > maxDelete {
+		return fmt.Errorf("Refusing to delete %d files, more than --max-delete %d", n, maxDelete)
+	}
+	if total > 0 {
+		percent := float64(n) * 100 / float64(total)
+		if percent > maxDeletePercent {
+			return fmt.Errorf("Refusing to delete %d of %d files (%.1f%%), more than --max-delete-percent %g", n, total, percent, maxDeletePercent)
+		}
+	}
 	return nil
 }
 
 func syncFiles(conn s3iface.S3API, src, dest string) error {
 	start := time.Now()
-	fs1 := getFilesystem(conn, src)
-	fs2 := getFilesystem(conn, dest)
-	ch1 := fs1.Files()
+	cmp, err := getComparator()
+	if err != nil {
+		return err
+	}
+	fs1 := sideFilesystem(conn, srcSettings, src)
+	fs2 := sideFilesystem(conn, destSettings, dest)
+	tracker := startProgress()
+	defer tracker.Stop()
+	counts, err := syncLists(fs1, fs2, fs1.Files(), fs2.Files(), cmp, 0)
+	if err != nil {
+		return err
+	}
+	tracker.Stop()
+	counts.bytes = tracker.Transferred()
+
+	end := time.Now()
+	took := end.Sub(start)
+	summary(counts, took)
+	return counts.failures()
+}
+
+// syncLists merges the sorted listings ch1 from fs1 and ch2 from fs2,
+// performing the actions to make fs2 match. destTotal is the number of
+// files in fs2 when ch2 lists only some of them, otherwise 0.
+func syncLists(fs1, fs2 Filesystem, ch1, ch2 <-chan File, cmp Comparator, destTotal int) (syncCounts, error) {
+	ch1 = filterFiles(ch1)
 	f1 := <-ch1
 
-	ch2 := fs2.Files()
+	ch2 = filterFiles(ch2)
 	f2 := <-ch2
 
-	// create pool for processing
-	wg := sync.WaitGroup{}
-	q := make(chan Action, 1000)
-	for i := 0; i < parallel; i += 1 {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for action := range q {
-				processAction(action, fs2)
-			}
-		}()
+	q, wait := startActions(fs2)
+	// with delete limits, hold all actions until the deletes are counted
+	var held []Action
+	queue := func(action Action) {
+		plan.Add(action)
+		if action.Action == "delete" {
+			progress.add(0)
+		} else {
+			progress.add(action.File.Size())
+		}
+		if deleteLimited() {
+			held = append(held, action)
+		} else {
+			q <- action
+		}
 	}
 
-	var added, deleted, updated, unchanged int
+	var counts syncCounts
+	destFiles := 0
 	var err error
 	for {
 		err = fs1.Error()
@@ -506,39 +745,98 @@ func syncFiles(conn s3iface.S3API, src, dest string) error {
 		// if f1 is nil and f2 is nil, we're done
 		// if f1 is nil or f1 < f2, create f1
 		// if f2 is nil or f1 > f2, delete f2
-		// if f1 = f2, check size, md5
+		// if f1 = f2, check with comparator
 		if f1 == nil && f2 == nil {
 			break
 		} else if f2 == nil || (f1 != nil && f1.Relative() < f2.Relative()) {
-			q <- Action{"create", f1}
-			added += 1
+			queue(Action{"create", f1, destMissing})
+			counts.added += 1
 			f1 = <-ch1
 		} else if f1 == nil || (f2 != nil && f1.Relative() > f2.Relative()) {
 			if deleteExtra {
-				q <- Action{"delete", f2}
-				deleted += 1
+				queue(Action{"delete", f2, srcMissing})
+				counts.deleted += 1
 			}
-			f2 = <-ch2
-		} else if f1.Size() != f2.Size() || bytes.Compare(f1.MD5(), f2.MD5()) != 0 {
-			q <- Action{"update", f1}
-			updated += 1
-			f1 = <-ch1
+			destFiles += 1
 			f2 = <-ch2
 		} else {
-			unchanged += 1
+			// skip comparing files the journal confirms are done
+			reason := ""
+			var differErr error
+			if !journal.Completed(f1) {
+				reason, differErr = cmp.Differ(f1, f2)
+			}
+			if differErr != nil {
+				// a file may vanish or become unreadable mid-scan, which
+				// fails it alone
+				reportAction(Action{"update", f1, ""}, differErr)
+				counts.failed += 1
+			} else if reason != "" {
+				queue(Action{"update", f1, reason})
+				counts.updated += 1
+			} else {
+				counts.unchanged += 1
+			}
+			destFiles += 1
 			f1 = <-ch1
 			f2 = <-ch2
 		}
 	}
 
-	close(q)
-	wg.Wait()
-	if err != nil {
-		return err
+	progress.complete()
+	if destTotal == 0 {
+		destTotal = destFiles
+	}
+	if err == nil && deleteLimited() {
+		err = checkDeletes(counts.deleted, destTotal)
+		if err == nil {
+			for _, action := range held {
+				q <- action
+			}
+		}
 	}
+	counts.failed += wait()
+	return counts, err
+}
 
-	end := time.Now()
-	took := end.Sub(start)
-	summary(added, deleted, updated, unchanged, took)
-	return nil
+// reportAction outputs the result of an action, if structured, or any
+// error.
+func reportAction(action Action, err error) {
+	if structured() {
+		emit(newActionRecord(action.Action, action.File.Relative(), action.File.Size(), err))
+	} else if err != nil {
+		fmt.Fprintf(out, "E %s: %s\n", action.File.Relative(), err)
+	}
+}
+
+// startActions starts a pool of parallel workers processing actions sent
+// to the returned channel, reporting any that fail. Calling wait closes the
+// channel, waits for them to finish and returns the number that failed.
+func startActions(fs2 Filesystem) (q chan<- Action, wait func() int) {
+	wg := sync.WaitGroup{}
+	ch := make(chan Action, 1000)
+	var failed int32
+	limit, stop := startConcurrency()
+	for i := 0; i < parallel; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for action := range ch {
+				limit.acquire()
+				err := processAction(action, fs2)
+				limit.release()
+				progress.done()
+				reportAction(action, err)
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	return ch, func() int {
+		close(ch)
+		wg.Wait()
+		stop()
+		return int(failed)
+	}
 }
@@ -0,0 +1,158 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Comparator decides whether an existing destination file needs updating
+// from the source file of the same name, returning the reason it differs or
+// "" if it doesn't.
+type Comparator interface {
+	Differ(src, dest File) (string, error)
+}
+
+// reasons given by comparators
+const (
+	sizeChanged  = "size-changed"
+	md5Changed   = "md5-changed"
+	mtimeChanged = "mtime-changed"
+)
+
+// checksumComparator updates when the size or md5 differ (the default).
+type checksumComparator struct{}
+
+func (self checksumComparator) Differ(src, dest File) (string, error) {
+	if src.Size() != dest.Size() {
+		return sizeChanged, nil
+	}
+	same, err := sameContent(src, dest)
+	if err != nil || same {
+		return "", err
+	}
+	return md5Changed, nil
+}
+
+// sameContent compares md5s, handling multipart uploads whose etag is not
+// the md5 of their content.
+func sameContent(f1, f2 File) (bool, error) {
+	s1, ok1 := f1.(*S3File)
+	s2, ok2 := f2.(*S3File)
+	if ok1 && ok2 && s1.etag() == s2.etag() {
+		return true, nil
+	}
+	if ok2 && s2.multipart() {
+		return sameMultipart(f1, s2)
+	}
+	if ok1 && s1.multipart() {
+		return sameMultipart(f2, s1)
+	}
+	return sameMD5(f1, f2)
+}
+
+func sameMD5(f1, f2 File) (bool, error) {
+	sum1, err := f1.MD5()
+	if err != nil {
+		return false, err
+	}
+	sum2, err := f2.MD5()
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sum1, sum2), nil
+}
+
+func sameMultipart(f File, s *S3File) (bool, error) {
+	// prefer the md5 stored in metadata
+	sum, err := s.MD5()
+	if err != nil {
+		return false, err
+	}
+	if sum != nil {
+		return sameMD5(f, s)
+	}
+	// otherwise compute the equivalent multipart etag
+	if l, ok := f.(*LocalFile); ok {
+		partSize, err := s.partSize()
+		if err != nil {
+			return false, err
+		}
+		etag, err := l.multipartETag(partSize)
+		return etag == s.etag(), err
+	}
+	return false, nil
+}
+
+// sizeComparator updates only when the size differs, avoiding hashing.
+type sizeComparator struct{}
+
+func (self sizeComparator) Differ(src, dest File) (string, error) {
+	if src.Size() != dest.Size() {
+		return sizeChanged, nil
+	}
+	return "", nil
+}
+
+// mtimeComparator updates when the size differs or the source has been
+// modified since the destination was written.
+type mtimeComparator struct{}
+
+func (self mtimeComparator) Differ(src, dest File) (string, error) {
+	if src.Size() != dest.Size() {
+		return sizeChanged, nil
+	}
+	if !src.ModTime().After(dest.ModTime()) {
+		return "", nil
+	}
+	// downloads are given the mtime recorded on upload, which is older than
+	// when the object was last modified. Those changed since the object
+	// was are up to date, otherwise the recorded mtime takes a head
+	// request.
+	if s, ok := src.(*S3File); ok {
+		if l, ok := dest.(*LocalFile); ok && !s.ModTime().After(changeTime(l.info)) {
+			return "", nil
+		}
+		mtime, err := s.mtime()
+		if err != nil || !mtime.After(dest.ModTime()) {
+			return "", err
+		}
+	}
+	return mtimeChanged, nil
+}
+
+// newerComparator never overwrites a destination that is more recent than
+// the source, otherwise deferring to another comparator.
+type newerComparator struct {
+	Comparator
+}
+
+func (self newerComparator) Differ(src, dest File) (string, error) {
+	if dest.ModTime().After(src.ModTime()) {
+		return "", nil
+	}
+	return self.Comparator.Differ(src, dest)
+}
+
+func getComparator() (Comparator, error) {
+	var cmp Comparator = checksumComparator{}
+	n := 0
+	if sizeOnly {
+		cmp = sizeComparator{}
+		n += 1
+	}
+	if compareChecksum {
+		cmp = checksumComparator{}
+		n += 1
+	}
+	if compareMtime {
+		cmp = mtimeComparator{}
+		n += 1
+	}
+	if n > 1 {
+		return nil, errors.New("only one of --size-only, --checksum or --mtime may be given")
+	}
+	if newerOnly {
+		cmp = newerComparator{cmp}
+	}
+	return cmp, nil
+}
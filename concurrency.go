@@ -0,0 +1,178 @@
+package s3
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// requestLimit limits the rate of S3 requests, set by --max-rps.
+var requestLimit *rateLimiter
+
+// concurrency limits how many operations the workers run at once, adjusted
+// with --adaptive.
+var concurrency *concurrencyLimit
+
+// adaptInterval is how often adaptive concurrency measures throughput.
+const adaptInterval = time.Second
+
+// throttlingCodes are the S3 error codes asking clients to slow down.
+var throttlingCodes = map[string]bool{
+	"RequestLimitExceeded": true,
+	"RequestThrottled":     true,
+	"SlowDown":             true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"TooManyRequests":      true,
+}
+
+// throttling returns whether err shows requests are being throttled.
+func throttling(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == 503 {
+		return true
+	}
+	if e, ok := err.(awserr.Error); ok {
+		return throttlingCodes[e.Code()]
+	}
+	return false
+}
+
+// concurrencyLimit is a semaphore whose size grows while throughput
+// improves, up to -p, and halves when requests are throttled.
+type concurrencyLimit struct {
+	sync.Mutex
+	cond          *sync.Cond
+	limit, active int
+	// completed counts operations since throughput was last measured, and
+	// saturated whether the limit was reached meanwhile
+	completed int
+	saturated bool
+	rate      float64
+	measured  time.Time
+	shrunk    time.Time
+	stop      chan bool
+	// shown is the limit for display, read without locking
+	shown int32
+}
+
+// startConcurrency returns the limit for a pool of workers, adjusting it
+// if --adaptive. Calling the returned function stops it.
+func startConcurrency() (*concurrencyLimit, func()) {
+	if !adaptive {
+		return nil, func() {}
+	}
+	limit := 4
+	if parallel < limit {
+		limit = parallel
+	}
+	concurrency = &concurrencyLimit{
+		limit:    limit,
+		measured: time.Now(),
+		stop:     make(chan bool),
+		shown:    int32(limit),
+	}
+	concurrency.cond = sync.NewCond(concurrency)
+	go concurrency.adapt()
+	return concurrency, func() {
+		close(concurrency.stop)
+		concurrency = nil
+	}
+}
+
+// acquire blocks until another operation may start.
+func (self *concurrencyLimit) acquire() {
+	if self == nil {
+		return
+	}
+	self.Lock()
+	for self.active >= self.limit {
+		self.cond.Wait()
+	}
+	self.active += 1
+	if self.active == self.limit {
+		self.saturated = true
+	}
+	self.Unlock()
+}
+
+// current returns the current limit, or 0 if not adaptive.
+func (self *concurrencyLimit) current() int {
+	if self == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&self.shown))
+}
+
+// release records an operation as finished.
+func (self *concurrencyLimit) release() {
+	if self == nil {
+		return
+	}
+	self.Lock()
+	self.active -= 1
+	self.completed += 1
+	self.Unlock()
+	self.cond.Signal()
+}
+
+func (self *concurrencyLimit) adapt() {
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+			self.grow()
+		}
+	}
+}
+
+// grow raises the limit while it is reached and throughput is improving.
+func (self *concurrencyLimit) grow() {
+	self.Lock()
+	defer self.Unlock()
+	now := time.Now()
+	rate := float64(self.completed) / now.Sub(self.measured).Seconds()
+	saturated := self.saturated
+	self.completed = 0
+	self.saturated = false
+	self.measured = now
+	if rate > self.rate && saturated && self.limit < parallel {
+		self.set(self.limit+self.limit/4+1, fmt.Sprintf("%.1f ops/s", rate))
+		self.cond.Broadcast()
+	}
+	self.rate = rate
+}
+
+// throttled halves the limit, at most once an interval as throttled
+// requests tend to come together.
+func (self *concurrencyLimit) throttled() {
+	if self == nil {
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	if time.Since(self.shrunk) < adaptInterval || self.limit == 1 {
+		return
+	}
+	self.shrunk = time.Now()
+	self.set(self.limit/2, "throttled")
+}
+
+func (self *concurrencyLimit) set(limit int, reason string) {
+	if limit > parallel {
+		limit = parallel
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if !quiet {
+		fmt.Fprintf(out, "concurrency: %d -> %d (%s)\n", self.limit, limit, reason)
+	}
+	self.limit = limit
+	atomic.StoreInt32(&self.shown, int32(limit))
+}
@@ -0,0 +1,287 @@
+package s3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// region is set by --region
+var region string
+
+// settings for S3 compatible servers, such as MinIO or Ceph
+var (
+	endpoint    string
+	pathStyle   bool
+	noVerifySSL bool
+	// caCerts are the certificates trusted with --ca-bundle
+	caCerts *x509.CertPool
+)
+
+// noSignRequest sends requests anonymously, for public buckets
+var noSignRequest bool
+
+// caBundleFlag is a cli.Generic loading the certificates to trust.
+type caBundleFlag struct {
+	filename string
+}
+
+func (self *caBundleFlag) Set(value string) error {
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		return err
+	}
+	caCerts = x509.NewCertPool()
+	if !caCerts.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", value)
+	}
+	self.filename = value
+	return nil
+}
+
+func (self *caBundleFlag) String() string {
+	return self.filename
+}
+
+// httpClient returns a client verifying certificates as set by
+// --no-verify-ssl and --ca-bundle.
+func httpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: noVerifySSL,
+		RootCAs:            caCerts,
+	}
+	return &http.Client{Transport: transport}
+}
+
+// connSettings select the account and server of a connection, defaulting
+// to --profile, --region and --endpoint.
+type connSettings struct {
+	profile, region, endpoint string
+}
+
+// account returns the profile and endpoint of settings, to compare whether
+// two connections reach the same account and server.
+func (self connSettings) account() connSettings {
+	if self.profile == "" {
+		self.profile = profile
+		if self.endpoint == "" {
+			self.endpoint = endpoint
+		}
+	}
+	self.region = ""
+	return self
+}
+
+// settings for each side of a sync, set by --src-profile and so on
+var srcSettings, destSettings connSettings
+
+// connect returns the connection for settings, set up by Main.
+var connect func(settings connSettings) s3iface.S3API
+
+// connector is a connection given to Main that makes the connection for
+// each settings itself, rather than standing in for all of them.
+type connector interface {
+	connect(settings connSettings) s3iface.S3API
+}
+
+var (
+	connections     map[connSettings]s3iface.S3API
+	connectionsLock sync.Mutex
+)
+
+// cachedConnection returns a connection for settings, reusing any made
+// before.
+func cachedConnection(settings connSettings) s3iface.S3API {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	conn, ok := connections[settings]
+	if !ok {
+		conn = newConnection(settings)
+		connections[settings] = conn
+	}
+	return conn
+}
+
+// bucketKey names a bucket on the account and server of a connection.
+type bucketKey struct {
+	account connSettings
+	bucket  string
+}
+
+// bucketRegions caches the region of each bucket, or "" if unknown.
+var (
+	bucketRegions     map[bucketKey]string
+	bucketRegionsLock sync.Mutex
+)
+
+// bucketRegion returns the region of bucket, asking conn the first time.
+func bucketRegion(conn s3iface.S3API, settings connSettings, bucket string) string {
+	bucketRegionsLock.Lock()
+	defer bucketRegionsLock.Unlock()
+	key := bucketKey{settings.account(), bucket}
+	if region, ok := bucketRegions[key]; ok {
+		return region
+	}
+	region := ""
+	output, err := conn.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		switch region = aws.StringValue(output.LocationConstraint); region {
+		case "":
+			region = "us-east-1"
+		case "EU":
+			region = "eu-west-1"
+		}
+	} else {
+		region = headerRegion(conn, bucket)
+	}
+	bucketRegions[key] = region
+	return region
+}
+
+// headerRegion returns the region of bucket from a head request, which
+// tells anyone the region, unlike the location only told to the owner.
+func headerRegion(conn s3iface.S3API, bucket string) string {
+	req, _ := conn.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if req == nil {
+		return ""
+	}
+	req.Send()
+	if req.HTTPResponse == nil {
+		return ""
+	}
+	return req.HTTPResponse.Header.Get("X-Amz-Bucket-Region")
+}
+
+// regionConnection returns a connection to the region of bucket, if it's
+// not the region of conn. Buckets on other endpoints or in a region set
+// explicitly are left alone.
+func regionConnection(conn s3iface.S3API, settings connSettings, bucket string) s3iface.S3API {
+	client, ok := conn.(*s3.S3)
+	if settings.region != "" || ok && aws.StringValue(client.Config.Endpoint) != "" {
+		return conn
+	}
+	region := bucketRegion(conn, settings, bucket)
+	if region == "" || ok && aws.StringValue(client.Config.Region) == region {
+		// unknown, such as a bucket not yet created
+		return conn
+	}
+	settings.region = region
+	return connect(settings)
+}
+
+// newConnection connects to S3 with the profile, in the region if set, or
+// the endpoint if set.
+func newConnection(settings connSettings) s3iface.S3API {
+	var err error
+	if settings.profile == "" {
+		settings.profile = profile
+		if settings.region == "" {
+			settings.region = region
+		}
+		if settings.endpoint == "" {
+			settings.endpoint = endpoint
+		}
+	} else {
+		err = profileSettings(&settings)
+	}
+	config := aws.Config{}
+	if err == nil {
+		err = profileConfig(settings.profile, &config)
+	}
+	if settings.region != "" {
+		config.Region = aws.String(settings.region)
+	}
+	if settings.endpoint != "" {
+		config.Endpoint = aws.String(settings.endpoint)
+	}
+	if pathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if noVerifySSL || caCerts != nil {
+		config.HTTPClient = httpClient()
+	}
+	if noSignRequest {
+		config.Credentials = credentials.AnonymousCredentials
+	}
+	var sess *session.Session
+	if err == nil {
+		sess, err = session.NewSessionWithOptions(session.Options{
+			Config:            config,
+			Profile:           settings.profile,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+	}
+	if err != nil {
+		// report the error on the first request
+		sess = session.New(&config)
+		sess.Handlers.Validate.PushBack(func(r *request.Request) {
+			r.Error = err
+		})
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String("us-east-1")
+	}
+	client := s3.New(sess)
+	// every request sent, including the SDK's own retries, counts towards
+	// --max-rps
+	client.Handlers.Send.PushFront(func(*request.Request) {
+		requestLimit.wait(1)
+	})
+	return client
+}
+
+// profileSettings defaults the region and endpoint to those of the
+// profile's section of the s3 config file, for a profile other than
+// --profile.
+func profileSettings(settings *connSettings) error {
+	name := settings.profile
+	section, err := loadSection(configFile(), "profile "+name, name)
+	if err != nil || section == nil {
+		return err
+	}
+	if settings.region == "" {
+		settings.region = section.Key("region").String()
+	}
+	if settings.endpoint == "" {
+		settings.endpoint = section.Key("endpoint").String()
+	}
+	return nil
+}
+
+// profileConfig applies the endpoint_url and credential_process settings
+// of the profile, which the SDK doesn't support.
+func profileConfig(name string, config *aws.Config) error {
+	if !noSignRequest {
+		// anonymous requests need no credentials from the profile
+		err := checkProfile(name)
+		if err != nil {
+			return err
+		}
+	}
+	url, err := awsSetting(name, "endpoint_url")
+	if err != nil {
+		return err
+	}
+	if url != "" {
+		config.Endpoint = aws.String(url)
+	}
+	command, err := awsSetting(name, "credential_process")
+	if err != nil {
+		return err
+	}
+	if command != "" {
+		config.Credentials = credentials.NewCredentials(&processProvider{command: command})
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package s3
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// changeTime returns when the file's contents or attributes last changed.
+func changeTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Ctim.Unix())
+	}
+	return time.Time{}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package s3
+
+import (
+	"os"
+	"time"
+)
+
+// changeTime is unavailable from os.FileInfo on other platforms, so is
+// never known.
+func changeTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
@@ -0,0 +1,185 @@
+package s3
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// filters are the --include/--exclude rules in command-line order, the
+// first matching rule deciding whether a file is included.
+var filters []filterRule
+
+type filterRule struct {
+	include bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// newFilterRule compiles an rsync-style pattern: a leading / anchors it to
+// the root of the transfer, a trailing / matches only directories, * and ?
+// do not match /, and ** matches anything including /.
+func newFilterRule(pattern string, include bool) (filterRule, error) {
+	rule := filterRule{include: include}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	prefix := "(^|/)"
+	if strings.HasPrefix(pattern, "/") {
+		prefix = "^"
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	var err error
+	rule.re, err = regexp.Compile(prefix + globToRegexp(pattern) + "$")
+	return rule, err
+}
+
+func globToRegexp(pattern string) string {
+	var re strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				// matches zero or more directories
+				re.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				re.WriteString(".*")
+				i += 1
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i += 1
+				c = pattern[i]
+			}
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return re.String()
+}
+
+func (self filterRule) match(path string, dir bool) bool {
+	if self.dirOnly && !dir {
+		return false
+	}
+	return self.re.MatchString(path)
+}
+
+// excludedBy returns whether the first rule matching path excludes it.
+func excludedBy(rules []filterRule, path string, dir bool) bool {
+	for _, rule := range rules {
+		if rule.match(path, dir) {
+			return !rule.include
+		}
+	}
+	return false
+}
+
+// excluded returns whether the filters exclude the relative path, either
+// directly or by excluding one of its parent directories.
+func excluded(path string) bool {
+	if len(filters) == 0 {
+		return false
+	}
+	path = filepath.ToSlash(path)
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		if excludedBy(filters, strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return excludedBy(filters, path, false)
+}
+
+// filterFiles drops files excluded by the filters from a listing.
+func filterFiles(files <-chan File) <-chan File {
+	if len(filters) == 0 {
+		return files
+	}
+	ch := make(chan File, 1000)
+	go func() {
+		defer close(ch)
+		for file := range files {
+			if !excluded(file.Relative()) {
+				ch <- file
+			}
+		}
+	}()
+	return ch
+}
+
+// filterFlag is a cli.Generic appending to the shared filters, so that
+// --include and --exclude keep their relative order.
+type filterFlag struct {
+	include  bool
+	fromFile bool
+}
+
+func (self *filterFlag) Set(value string) error {
+	if self.fromFile {
+		return readFilterFile(value)
+	}
+	rule, err := newFilterRule(value, self.include)
+	if err != nil {
+		return err
+	}
+	filters = append(filters, rule)
+	return nil
+}
+
+func (self *filterFlag) String() string {
+	return ""
+}
+
+// readFilterFile reads exclude patterns one per line. Blank lines and lines
+// starting # or ; are ignored, and lines may be prefixed "+ " to include or
+// "- " to exclude.
+func readFilterFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		include := false
+		if strings.HasPrefix(line, "+ ") {
+			include = true
+			line = line[2:]
+		} else if strings.HasPrefix(line, "- ") {
+			line = line[2:]
+		}
+		rule, err := newFilterRule(line, include)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, rule)
+	}
+	return scanner.Err()
+}
@@ -1,11 +1,15 @@
 package s3
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 type File interface {
 	Relative() string
 	Size() int64
-	MD5() []byte
+	ModTime() time.Time
+	MD5() ([]byte, error)
 	Reader() (io.ReadCloser, error)
 	Delete() error
 	String() string
@@ -14,6 +18,7 @@ type File interface {
 
 type Filesystem interface {
 	Files() <-chan File
+	FilesUnder(relpath string) <-chan File
 	Create(src File) error
 	Delete(path string) error
 	Error() error
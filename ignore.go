@@ -0,0 +1,124 @@
+package s3
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const s3ignoreFile = ".s3ignore"
+
+// ignoreFile holds the patterns of a .s3ignore (or .gitignore) file, which
+// apply to paths beneath the directory containing it.
+type ignoreFile struct {
+	dir   string
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// newIgnoreRule compiles a gitignore pattern: a leading ! negates, a
+// trailing / matches only directories, and a / at the start or middle
+// anchors the pattern to the ignore file's directory. Otherwise it matches
+// a name at any depth.
+func newIgnoreRule(pattern string) (ignoreRule, error) {
+	rule := ignoreRule{}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	prefix := "(^|/)"
+	if strings.Contains(pattern, "/") {
+		prefix = "^"
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+	var err error
+	rule.re, err = regexp.Compile(prefix + globToRegexp(pattern) + "$")
+	return rule, err
+}
+
+func loadIgnoreFile(dir, name string) (*ignoreFile, error) {
+	filename := filepath.Join(dir, name)
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ignore := &ignoreFile{dir: dir}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " \t\r")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := newIgnoreRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		ignore.rules = append(ignore.rules, rule)
+	}
+	return ignore, scanner.Err()
+}
+
+// loadIgnoreFiles appends the ignore files found in dir to those inherited
+// from its parents.
+func loadIgnoreFiles(ignores []*ignoreFile, dir string) ([]*ignoreFile, error) {
+	names := []string{s3ignoreFile}
+	if useGitignore {
+		names = append(names, ".gitignore")
+	}
+	// copy so siblings don't share appends
+	ignores = ignores[:len(ignores):len(ignores)]
+	for _, name := range names {
+		ignore, err := loadIgnoreFile(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if ignore != nil {
+			ignores = append(ignores, ignore)
+		}
+	}
+	return ignores, nil
+}
+
+// ignored returns whether the file at fullpath is ignored. The last
+// matching pattern wins, with deeper ignore files taking precedence.
+func ignored(ignores []*ignoreFile, fullpath string, dir bool) bool {
+	if useGitignore && dir && filepath.Base(fullpath) == ".git" {
+		return true
+	}
+	result := false
+	for _, ignore := range ignores {
+		path, err := filepath.Rel(ignore.dir, fullpath)
+		if err != nil {
+			continue
+		}
+		path = filepath.ToSlash(path)
+		for _, rule := range ignore.rules {
+			if (!rule.dirOnly || dir) && rule.re.MatchString(path) {
+				result = !rule.negate
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,8 @@
+package s3
+
+import "os"
+
+// inode is unavailable from os.FileInfo on windows.
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,78 @@
+@apply
+Feature: apply command
+
+  Scenario: sync --plan-out writes a plan without changing anything
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "b" contains "OLD"
+    And bucket "s3.barnybug.github.com" key "c" contains "C"
+    And local file "src/a" contains "A"
+    And local file "src/b" contains "NEW!"
+    And local file "src/a" was modified at "2016-01-01T00:00:00Z"
+    And local file "src/b" was modified at "2016-01-02T00:00:00Z"
+    When I run "s3 sync --delete --plan-out plan.json src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" key "a" does not exist
+    And bucket "s3.barnybug.github.com" has key "b" with contents "OLD"
+    And bucket "s3.barnybug.github.com" key "c" exists
+    And local file "plan.json" has contents "{\n  "source": "src/",\n  "destination": "s3://s3.barnybug.github.com/",\n  "actions": [\n    {\n      "action": "create",\n      "path": "a",\n      "source": "src/a",\n      "destination": "s3://s3.barnybug.github.com/a",\n      "size": 1,\n      "mtime": "2016-01-01T00:00:00Z",\n      "reason": "missing"\n    },\n    {\n      "action": "update",\n      "path": "b",\n      "source": "src/b",\n      "destination": "s3://s3.barnybug.github.com/b",\n      "size": 4,\n      "mtime": "2016-01-02T00:00:00Z",\n      "reason": "size-changed"\n    },\n    {\n      "action": "delete",\n      "path": "c",\n      "destination": "s3://s3.barnybug.github.com/c",\n      "size": 1,\n      "etag": "0d61f8370cad1d412f80b84d143e1257",\n      "reason": "extra"\n    }\n  ]\n}\n"
+
+  Scenario: I can apply a plan
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "b" contains "OLD"
+    And bucket "s3.barnybug.github.com" key "c" contains "C"
+    And local file "src/a" contains "A"
+    And local file "src/b" contains "NEW!"
+    When I run "s3 sync --delete --plan-out plan.json src/ s3://s3.barnybug.github.com/"
+    And I run "s3 apply plan.json"
+    Then bucket "s3.barnybug.github.com" has key "a" with contents "A"
+    And bucket "s3.barnybug.github.com" has key "b" with contents "NEW!"
+    And bucket "s3.barnybug.github.com" key "c" does not exist
+    And the output contains "1 added 1 deleted 1 updated 0 unchanged 0 failed\n"
+
+  Scenario: apply refuses a plan when files have changed
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "src/b" contains "B"
+    When I run "s3 sync --plan-out plan.json src/ s3://s3.barnybug.github.com/"
+    And local file "src/b" contains "CHANGED"
+    And I run "s3 apply plan.json"
+    Then the exit code is 1
+    And bucket "s3.barnybug.github.com" key "a" does not exist
+
+  Scenario: apply refuses a plan when files have changed without changing size
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "src/a" was modified at "2016-01-01T00:00:00Z"
+    When I run "s3 sync --plan-out plan.json src/ s3://s3.barnybug.github.com/"
+    And local file "src/a" contains "B"
+    And I run "s3 apply plan.json"
+    Then the exit code is 1
+    And the output contains "src/a has changed since the plan was made"
+    And bucket "s3.barnybug.github.com" key "a" does not exist
+
+  Scenario: apply refuses a plan when objects have changed without changing size
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "a" contains "A"
+    And local file "src/b" contains "B"
+    When I run "s3 sync --delete --plan-out plan.json src/ s3://s3.barnybug.github.com/"
+    And bucket "s3.barnybug.github.com" key "a" contains "B"
+    And I run "s3 apply plan.json"
+    Then the exit code is 1
+    And the output contains "s3://s3.barnybug.github.com/a has changed since the plan was made"
+    And bucket "s3.barnybug.github.com" has key "a" with contents "B"
+    And bucket "s3.barnybug.github.com" key "b" does not exist
+
+  Scenario: apply requires a plan
+    When I run "s3 apply"
+    Then the exit code is 1
+
+  Scenario: sync --plan-out locates the files of a source without a trailing slash
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    When I run "s3 sync --plan-out plan.json src s3://s3.barnybug.github.com/"
+    Then local file "plan.json" includes ""path": "src/a",\n      "source": "src/a",\n      "destination": "s3://s3.barnybug.github.com/src/a""
+
+    Given local file "src/a" contains "AA"
+    When I run "s3 apply plan.json"
+    Then the exit code is 1
+    And the output contains "src/a has changed since the plan was made"
+    And the output does not contain "src/src/a"
@@ -18,3 +18,20 @@ Feature: cat command
   	Given I have bucket "s3.barnybug.github.com"
     When I run "s3 cat s3://s3.barnybug.github.com/key"
     Then the exit code is 1
+
+  Scenario: I can cat files with --no-sign-request
+    Given an S3 compatible server
+    And the server has key "apple" with contents "APPLE"
+    When I run "s3 --no-sign-request --endpoint SERVER --path-style cat s3://s3.barnybug.github.com/apple" against the server
+    Then the exit code is 0
+    And the output contains "APPLE"
+    And the server received unsigned requests
+
+  Scenario: I can cat files on an S3 compatible server
+    Given an S3 compatible server
+    And the server has key "apple" with contents "APPLE"
+    When I run "s3 --endpoint SERVER --path-style cat s3://s3.barnybug.github.com/apple" against the server
+    Then the exit code is 0
+    And the output contains "APPLE"
+    And the server received "GET /s3.barnybug.github.com/apple"
+    And the server received signed requests
@@ -16,6 +16,39 @@ Feature: get command
     Then local file "aardvark" has contents "AARDVARK"
     And local file "apple" has contents "APPLE"
 
+  Scenario: get --links preserve recreates symlinks preserved in metadata
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local symlink "src/link" points to "a"
+    When I run "s3 sync --links preserve src/ s3://s3.barnybug.github.com/"
+    And I run "s3 get --links preserve s3://s3.barnybug.github.com/link"
+    Then local file "link" links to "a"
+
+  Scenario: get downloads symlinks preserved in metadata as files by default
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "link" is a symlink to "a"
+    When I run "s3 get s3://s3.barnybug.github.com/link"
+    Then the exit code is 0
+    And local file "link" is not a link
+
+  Scenario: get --links preserve refuses symlinks leaving the destination
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "absolute" is a symlink to "/tmp"
+    And bucket "s3.barnybug.github.com" key "dir/parent" is a symlink to "../.."
+    When I run "s3 get --links preserve s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And local file "absolute" does not exist
+    And local file "dir/parent" does not exist
+
+  Scenario: get --links preserve does not write through symlinks it created
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "dir" is a symlink to "other"
+    And bucket "s3.barnybug.github.com" key "dir/file" contains "F"
+    And local file "other/a" contains "A"
+    When I run "s3 get --links preserve s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And local file "other/file" does not exist
+
   Scenario: I can get a directory
     Given I have bucket "s3.barnybug.github.com"
     And bucket "s3.barnybug.github.com" key "test/aardvark" contains "AARDVARK"
@@ -30,6 +63,14 @@ Feature: get command
     When I run "s3 get s3://s3.barnybug.github.com/test/"
     Then local file "aardvark" has contents "AARDVARK"
 
+  Scenario: get restores modification times
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "src/a" was modified at "2016-01-02T03:04:05Z"
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/"
+    And I run "s3 get s3://s3.barnybug.github.com/a"
+    Then local file "a" was last modified at "2016-01-02T03:04:05Z"
+
   Scenario: get from a non-existent bucket is an error
     When I run "s3 get s3://s3.barnybug.github.com/key"
     Then the exit code is 1
@@ -43,3 +84,62 @@ Feature: get command
   	Given I have bucket "s3.barnybug.github.com"
     When I run "s3 get ."
     Then the exit code is 1
+
+  Scenario: get retries failed downloads
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "key" contains "ABCDEFGH"
+    And bucket "s3.barnybug.github.com" key "key" fails 2 times on GetObject
+    When I run "s3 --retry-backoff 1ms get s3://s3.barnybug.github.com/key"
+    Then local file "key" has contents "ABCDEFGH"
+
+  Scenario: get resumes truncated downloads
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "key" contains "ABCDEFGH"
+    And bucket "s3.barnybug.github.com" key "key" downloads are truncated 2 times
+    When I run "s3 --retry-backoff 1ms get s3://s3.barnybug.github.com/key"
+    Then local file "key" has contents "ABCDEFGH"
+
+  Scenario: get gives up after --retries
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "key" contains "ABCDEFGH"
+    And bucket "s3.barnybug.github.com" key "key" fails 3 times on GetObject
+    When I run "s3 --retries 2 --retry-backoff 1ms get s3://s3.barnybug.github.com/key"
+    Then the exit code is 1
+
+  Scenario: get limits download bandwidth
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src" contains 3072 bytes of "x"
+    When I run "s3 put src s3://s3.barnybug.github.com/key"
+    And I run "s3 --bwlimit 1K get s3://s3.barnybug.github.com/key"
+    Then the exit code is 0
+    And it was slowed by at least 1.9s
+
+  Scenario: get logs progress to stderr when not on a terminal
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "key" contains "ABCDEFGHIJ"
+    And bucket "s3.barnybug.github.com" key "key" fails 1 time on Slow
+    And progress is logged every 5ms
+    When I run "s3 get s3://s3.barnybug.github.com/key"
+    Then local file "key" has contents "ABCDEFGHIJ"
+    And stderr contains "progress: 0/1 files, "
+    And stderr contains " B/10 B, "
+    And stderr contains ", ETA "
+    And the output does not contain "progress:"
+
+  Scenario: get --adaptive logs its concurrency with progress
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "key" contains "ABCDEFGHIJ"
+    And bucket "s3.barnybug.github.com" key "key" fails 1 time on Slow
+    And progress is logged every 5ms
+    When I run "s3 --adaptive -p 8 get s3://s3.barnybug.github.com/key"
+    Then stderr contains ", concurrency 4"
+
+  Scenario: get with an invalid --bwlimit is an error
+    When I run "s3 --bwlimit 10X get s3://s3.barnybug.github.com/key"
+    Then the exit code is 1
+
+  Scenario: I can get a file with --no-sign-request
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "path/key" contains "123"
+    When I run "s3 --no-sign-request get s3://s3.barnybug.github.com/path/key"
+    Then local file "key" has contents "123"
@@ -10,6 +10,18 @@ Feature: grep command
     Then the output contains "s3://s3.barnybug.github.com/carrot:CARROT\n"
     Then the output contains "s3://s3.barnybug.github.com/orange:ORANGE\n"
 
+  Scenario: grep outputs ndjson records
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "carrot" contains "CARROT"
+    When I run "s3 --output ndjson grep CARROT s3://s3.barnybug.github.com/"
+    Then the output is "{\"key\":\"s3://s3.barnybug.github.com/carrot\",\"line\":\"CARROT\"}\n"
+
+  Scenario: grep -l outputs json records
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "carrot" contains "CARROT"
+    When I run "s3 --output json grep -l CARROT s3://s3.barnybug.github.com/"
+    Then the output is "[\n  {\n    \"key\": \"s3://s3.barnybug.github.com/carrot\"\n  }\n]\n"
+
   Scenario: grep requires at least 2 arguments
     When I run "s3 grep carrot"
     Then the exit code is 1
@@ -22,3 +34,11 @@ Feature: grep command
   	Given I have bucket "s3.barnybug.github.com"
     When I run "s3 grep carrot s3://s3.barnybug.github.com/key"
     Then the exit code is 1
+
+  Scenario: I can grep files with --no-sign-request
+    Given an S3 compatible server
+    And the server has key "carrot" with contents "CARROT"
+    When I run "s3 --no-sign-request --endpoint SERVER --path-style grep CARROT s3://s3.barnybug.github.com/" against the server
+    Then the exit code is 0
+    And the output contains "s3://s3.barnybug.github.com/carrot:CARROT\n"
+    And the server received unsigned requests
@@ -18,3 +18,158 @@ Feature: ls command
     And bucket "s3.barnybug.github.com" key "banana" contains "456"
     When I run "s3 ls s3://s3.barnybug.github.com/a"
     Then the output is "s3://s3.barnybug.github.com/aardvark\t1b\ns3://s3.barnybug.github.com/apple\t2b\n\n2 files, 3 bytes\n"
+
+  Scenario: I can exclude keys
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple.txt" contains "1"
+    And bucket "s3.barnybug.github.com" key "logs/today.log" contains "23"
+    And bucket "s3.barnybug.github.com" key "banana.log" contains "456"
+    When I run "s3 ls --exclude *.log s3://s3.barnybug.github.com/"
+    Then the output is "s3://s3.barnybug.github.com/apple.txt\t1b\n\n1 files, 1 bytes\n"
+
+  Scenario: The first matching filter wins
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple.txt" contains "1"
+    And bucket "s3.barnybug.github.com" key "logs/keep.log" contains "23"
+    And bucket "s3.barnybug.github.com" key "logs/today.log" contains "456"
+    When I run "s3 ls --include keep.log --exclude *.log s3://s3.barnybug.github.com/"
+    Then the output is "s3://s3.barnybug.github.com/apple.txt\t1b\ns3://s3.barnybug.github.com/logs/keep.log\t2b\n\n2 files, 3 bytes\n"
+
+  Scenario: Excluding a directory excludes its contents
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple.txt" contains "1"
+    And bucket "s3.barnybug.github.com" key "logs/keep.log" contains "23"
+    When I run "s3 ls --include keep.log --exclude /logs/ s3://s3.barnybug.github.com/"
+    Then the output is "s3://s3.barnybug.github.com/apple.txt\t1b\n\n1 files, 1 bytes\n"
+
+  Scenario: I can include keys with **
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "a/b/c.txt" contains "1"
+    And bucket "s3.barnybug.github.com" key "a/d.txt" contains "23"
+    And bucket "s3.barnybug.github.com" key "a/e.log" contains "456"
+    When I run "s3 ls --include */ --include a/**.txt --exclude * s3://s3.barnybug.github.com/"
+    Then the output is "s3://s3.barnybug.github.com/a/b/c.txt\t1b\ns3://s3.barnybug.github.com/a/d.txt\t2b\n\n2 files, 3 bytes\n"
+
+  Scenario: I can read excludes from a file
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple.txt" contains "1"
+    And bucket "s3.barnybug.github.com" key "banana.log" contains "23"
+    And local file "excludes" contains "*.log"
+    When I run "s3 ls --exclude-from excludes s3://s3.barnybug.github.com/"
+    Then the output is "s3://s3.barnybug.github.com/apple.txt\t1b\n\n1 files, 1 bytes\n"
+
+  Scenario: I can list buckets as ndjson
+    Given I have bucket "s3.barnybug.github.com"
+    When I run "s3 --output ndjson ls"
+    Then the output is "{\"bucket\":\"s3.barnybug.github.com\"}\n"
+
+  Scenario: I can list keys as ndjson
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "23"
+    When I run "s3 --output ndjson ls s3://s3.barnybug.github.com/"
+    Then the output contains "{\"key\":\"s3://s3.barnybug.github.com/apple\",\"size\":2,\"etag\":\"37693cfc748049e45d87b8c7d8b9aacd\",\"last_modified\":\""
+    And the output contains "\n{\"summary\":{\"files\":1,\"bytes\":2}}\n"
+
+  Scenario: I can list keys as json
+    Given I have bucket "s3.barnybug.github.com"
+    When I run "s3 --output json ls s3://s3.barnybug.github.com/"
+    Then the output is "[\n  {\n    \"summary\": {\n      \"files\": 0,\n      \"bytes\": 0\n    }\n  }\n]\n"
+
+  Scenario: an invalid --output is an error
+    When I run "s3 --output xml ls"
+    Then the exit code is 1
+
+  Scenario: a missing --ca-bundle is an error
+    When I run "s3 --ca-bundle missing.pem ls"
+    Then the exit code is 1
+
+  Scenario: I can list keys in a bucket in another region
+    Given I have a bucket "s3.barnybug.github.com" in region "eu-west-1"
+    And bucket "s3.barnybug.github.com" key "apple" contains "A"
+    When I run "s3 ls s3://s3.barnybug.github.com/"
+    Then the output contains "s3://s3.barnybug.github.com/apple"
+    And a connection was made to region "eu-west-1"
+    And the region of a bucket was looked up 1 time
+
+  Scenario: the region of a bucket of another account is found from its headers
+    Given I have a bucket "s3.barnybug.github.com" in region "eu-west-1"
+    And bucket "s3.barnybug.github.com" key "apple" contains "A"
+    And the location of bucket "s3.barnybug.github.com" is denied
+    When I run "s3 ls s3://s3.barnybug.github.com/"
+    Then the output contains "s3://s3.barnybug.github.com/apple"
+    And a connection was made to region "eu-west-1"
+    And the region of a bucket was looked up 2 times
+
+  Scenario: I can list keys through an alias
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "site/apple" contains "A"
+    And bucket "s3.barnybug.github.com" key "other/banana" contains "B"
+    And the s3 config file contains "[alias site]\nbucket = s3.barnybug.github.com\nprefix = site/\n"
+    When I run "s3 ls s3://site/"
+    Then the output contains "s3://s3.barnybug.github.com/site/apple"
+    And the output does not contain "banana"
+
+  Scenario: an alias without a bucket is an error
+    Given the s3 config file contains "[alias site]\nprefix = site/\n"
+    When I run "s3 ls s3://site/"
+    Then the exit code is 1
+    And the output contains "alias site: bucket is required"
+
+  Scenario: I can list keys with --no-sign-request
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "A"
+    When I run "s3 --no-sign-request ls s3://s3.barnybug.github.com/"
+    Then the exit code is 0
+    And the output contains "s3://s3.barnybug.github.com/apple"
+
+  Scenario: I can list keys on an S3 compatible server
+    Given an S3 compatible server
+    When I run "s3 --endpoint SERVER --path-style ls s3://s3.barnybug.github.com/" against the server
+    Then the exit code is 0
+    And the server received "GET /s3.barnybug.github.com"
+
+  Scenario: requests are signed with the credentials
+    Given an S3 compatible server
+    When I run "s3 --endpoint SERVER --path-style ls s3://s3.barnybug.github.com/" against the server
+    Then the exit code is 0
+    And the server received signed requests
+
+  Scenario: --no-sign-request sends anonymous requests
+    Given an S3 compatible server
+    When I run "s3 --no-sign-request --endpoint SERVER --path-style ls s3://s3.barnybug.github.com/" against the server
+    Then the exit code is 0
+    And the server received unsigned requests
+
+  Scenario: --no-sign-request needs no profile
+    Given an S3 compatible server
+    When I run "s3 --profile missing --no-sign-request --endpoint SERVER --path-style ls s3://s3.barnybug.github.com/" against the server
+    Then the exit code is 0
+    And the server received unsigned requests
+
+  Scenario: I can set the S3 compatible server in the environment
+    Given an S3 compatible server
+    And the environment variable "S3_ENDPOINT" is "SERVER"
+    And the environment variable "S3_PATH_STYLE" is "true"
+    When I run "s3 ls s3://s3.barnybug.github.com/" against the server
+    Then the exit code is 0
+    And the server received "GET /s3.barnybug.github.com"
+
+  Scenario: certificates of an S3 compatible server are verified
+    Given an S3 compatible server with a self-signed certificate
+    When I run "s3 --retries 0 --endpoint SERVER --path-style ls s3://s3.barnybug.github.com/" against the server
+    Then the exit code is 1
+
+  Scenario: I can skip verifying the certificate of an S3 compatible server
+    Given an S3 compatible server with a self-signed certificate
+    When I run "s3 --endpoint SERVER --path-style --no-verify-ssl ls s3://s3.barnybug.github.com/" against the server
+    Then the exit code is 0
+    And the server received "GET /s3.barnybug.github.com"
+
+  Scenario: I can skip verifying certificates in the environment
+    Given an S3 compatible server with a self-signed certificate
+    And the environment variable "AWS_ENDPOINT_URL" is "SERVER"
+    And the environment variable "S3_PATH_STYLE" is "true"
+    And the environment variable "S3_NO_VERIFY_SSL" is "true"
+    When I run "s3 ls s3://s3.barnybug.github.com/" against the server
+    Then the exit code is 0
+    And the server received "GET /s3.barnybug.github.com"
@@ -33,6 +33,14 @@ Feature: put command
     When I run "s3 put top/path/ s3://s3.barnybug.github.com/here/"
     Then bucket "s3.barnybug.github.com" has key "here/key" with contents "abc"
 
+  Scenario: I can put keys server-side without downloading them
+    Given I have bucket "s3.barnybug.github.com"
+    And I have bucket "s3b.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "APPLE"
+    When I run "s3 put s3://s3.barnybug.github.com/apple s3://s3b.barnybug.github.com/"
+    Then there were 0 GetObject requests
+    And bucket "s3b.barnybug.github.com" has key "apple" with contents "APPLE"
+
   Scenario: put a non-existent file is an error
     When I run "s3 put missing s3://s3.barnybug.github.com/"
     Then the exit code is 1
@@ -46,3 +54,17 @@ Feature: put command
     Given local file "key" contains "abc"
     When I run "s3 put key path"
     Then the exit code is 1
+
+  Scenario: put limits upload bandwidth
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "key" contains 3072 bytes of "x"
+    When I run "s3 --bwlimit-up 1K put key s3://s3.barnybug.github.com/"
+    Then the exit code is 0
+    And it was slowed by at least 1.9s
+
+  Scenario: put reports bytes transferred
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "key" contains 2048 bytes of "x"
+    When I run "s3 put key s3://s3.barnybug.github.com/"
+    Then the output contains "1 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+    And the output contains "transferred: 2.0 KB ("
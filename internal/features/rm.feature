@@ -31,3 +31,61 @@ Feature: rm command
     When I run "s3 rm localfile"
     Then the exit code is 1
     And local file "localfile" has contents "abc"
+
+  Scenario: rm refuses to remove a whole bucket
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "1"
+    When I run "s3 rm s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And bucket "s3.barnybug.github.com" key "apple" exists
+
+  Scenario: rm --force removes a whole bucket
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "1"
+    And bucket "s3.barnybug.github.com" key "banana" contains "1"
+    When I run "s3 rm --force s3://s3.barnybug.github.com"
+    Then bucket "s3.barnybug.github.com" key "apple" does not exist
+    And bucket "s3.barnybug.github.com" key "banana" does not exist
+
+  Scenario: rm --max-delete aborts before removing anything
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "1"
+    And bucket "s3.barnybug.github.com" key "avocado" contains "1"
+    When I run "s3 rm --max-delete 1 s3://s3.barnybug.github.com/a"
+    Then the exit code is 1
+    And bucket "s3.barnybug.github.com" key "apple" exists
+    And bucket "s3.barnybug.github.com" key "avocado" exists
+
+  Scenario: rm --max-delete-percent aborts before removing too much of the bucket
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "1"
+    And bucket "s3.barnybug.github.com" key "avocado" contains "1"
+    And bucket "s3.barnybug.github.com" key "banana" contains "1"
+    When I run "s3 rm --max-delete-percent 50 s3://s3.barnybug.github.com/a"
+    Then the exit code is 1
+    And the output contains "Refusing to delete 2 of 3 files"
+    And bucket "s3.barnybug.github.com" key "apple" exists
+    And bucket "s3.barnybug.github.com" key "avocado" exists
+
+  Scenario: rm --max-delete-percent allows removing less of the bucket
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "1"
+    And bucket "s3.barnybug.github.com" key "banana" contains "1"
+    And bucket "s3.barnybug.github.com" key "cherry" contains "1"
+    When I run "s3 rm --max-delete-percent 50 s3://s3.barnybug.github.com/a"
+    Then the exit code is 0
+    And bucket "s3.barnybug.github.com" key "apple" does not exist
+    And bucket "s3.barnybug.github.com" key "banana" exists
+
+  Scenario: rm outputs ndjson records
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "a" contains "A"
+    And bucket "s3.barnybug.github.com" key "b" contains "BB"
+    And bucket "s3.barnybug.github.com" key "b" fails 1 time on DeleteObject
+    When I run "s3 --output ndjson rm s3://s3.barnybug.github.com/a s3://s3.barnybug.github.com/b"
+    Then the exit code is 1
+    And the output contains "{\"action\":\"delete\",\"key\":\"s3://s3.barnybug.github.com/a\",\"bytes\":1}\n"
+    And the output contains "{\"action\":\"delete\",\"key\":\"s3://s3.barnybug.github.com/b\",\"bytes\":2,\"error\":\"SlowDown: Please reduce your request rate.\"}\n"
+    And the output contains "{\"summary\":{\"added\":0,\"deleted\":2,\"updated\":0,\"unchanged\":0,\"failed\":1,\"bytes\":0,\"seconds\":"
+    And the output contains "{\"error\":\"1 failed\"}\n"
+    And bucket "s3.barnybug.github.com" key "b" exists
@@ -2,13 +2,19 @@ package features
 
 import (
 	"bytes"
+	"crypto/md5"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	awss3 "github.com/aws/aws-sdk-go/service/s3"
@@ -20,10 +26,18 @@ import (
 var conn s3iface.S3API
 var testBuckets []string
 var out bytes.Buffer
+var stderr bytes.Buffer
+
+// written guards out, written by the command while steps may read it.
+var written = threadSafeWriter{Writer: &out}
 var lastExitCode int
+var mockClock *s3.MockClock
 var tempDir string
+var server *fakeServer
+var environ = map[string]*string{}
+var watchChanges []func(root string, events chan<- string)
 
-var replacer = strings.NewReplacer(`\n`, "\n", `\t`, "\t")
+var replacer = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`)
 
 func deleteAllKeys(bucket string) {
 	truncated := true
@@ -84,6 +98,148 @@ func bucketExists(bucket string) bool {
 	return false
 }
 
+func createLocalFile(filename string, content string) {
+	// create containing directory if necessary
+	dirname := path.Dir(filename)
+	if dirname != "" {
+		if _, err := os.Stat(dirname); os.IsNotExist(err) {
+			err := os.MkdirAll(dirname, 0755)
+			if err != nil {
+				T.Errorf("Couldn't create directory: %s\n%s", dirname, err)
+				return
+			}
+		}
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		T.Errorf("Couldn't create file: %s\n%s", filename, err)
+		return
+	}
+	defer file.Close()
+	file.WriteString(replacer.Replace(content))
+}
+
+// watching adds a change to make while sync --watch runs, after the
+// initial sync.
+func watching(change func(root string, events chan<- string)) {
+	if watchChanges == nil {
+		s3.MockWatch(func(root string, events chan<- string) {
+			// a path that doesn't exist, received once the initial sync is done
+			events <- path.Join(root, ".watching")
+			for _, change := range watchChanges {
+				change(root, events)
+			}
+		})
+	}
+	watchChanges = append(watchChanges, change)
+}
+
+// fakeServer is an S3 compatible server recording the requests made to
+// it, serving the keys it has in any path-style bucket.
+type fakeServer struct {
+	*httptest.Server
+	sync.Mutex
+	requests []*http.Request
+	keys     map[string]string
+}
+
+func newFakeServer(tls bool) *fakeServer {
+	self := &fakeServer{keys: map[string]string{}}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		self.Lock()
+		defer self.Unlock()
+		self.requests = append(self.requests, r)
+		// /bucket or /bucket/key
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if len(parts) == 2 && (r.Method == "GET" || r.Method == "HEAD") {
+			content, ok := self.keys[parts[1]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum([]byte(content))))
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			fmt.Fprint(w, content)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><IsTruncated>false</IsTruncated>`)
+		for key, content := range self.keys {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><ETag>"%x"</ETag><LastModified>2016-01-01T00:00:00.000Z</LastModified></Contents>`, key, len(content), md5.Sum([]byte(content)))
+			}
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	})
+	self.Server = httptest.NewUnstartedServer(handler)
+	// quieten the handshake errors of unverified certificates
+	self.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if tls {
+		self.StartTLS()
+	} else {
+		self.Start()
+	}
+	return self
+}
+
+func (self *fakeServer) Put(key, content string) {
+	self.Lock()
+	defer self.Unlock()
+	self.keys[key] = content
+}
+
+// Signed returns whether the requests made were all signed, or all
+// unsigned if not signed.
+func (self *fakeServer) Signed(signed bool) bool {
+	self.Lock()
+	defer self.Unlock()
+	for _, r := range self.requests {
+		if (r.Header.Get("Authorization") != "") != signed {
+			return false
+		}
+	}
+	return len(self.requests) > 0
+}
+
+// Requests returns the requests made, as "METHOD path".
+func (self *fakeServer) Requests() []string {
+	self.Lock()
+	defer self.Unlock()
+	var requests []string
+	for _, r := range self.requests {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+	}
+	return requests
+}
+
+// setenv sets an environment variable, or unsets it if value is nil, until
+// the end of the scenario.
+func setenv(name string, value *string) {
+	if _, ok := environ[name]; !ok {
+		if old, ok := os.LookupEnv(name); ok {
+			environ[name] = &old
+		} else {
+			environ[name] = nil
+		}
+	}
+	if value == nil {
+		os.Unsetenv(name)
+	} else {
+		os.Setenv(name, *value)
+	}
+}
+
+func startServer(tls bool) {
+	server = newFakeServer(tls)
+	// isolate from any user credentials or certificates
+	setenv("AWS_CONFIG_FILE", aws.String(path.Join(tempDir, "aws-config")))
+	setenv("AWS_SHARED_CREDENTIALS_FILE", aws.String(path.Join(tempDir, "aws-credentials")))
+	setenv("AWS_ACCESS_KEY_ID", aws.String("AKID"))
+	setenv("AWS_SECRET_ACCESS_KEY", aws.String("SECRET"))
+	setenv("AWS_CA_BUNDLE", nil)
+}
+
 type threadSafeWriter struct {
 	io.Writer
 	sync.Mutex
@@ -98,9 +254,18 @@ func (t *threadSafeWriter) Write(p []byte) (n int, err error) {
 func init() {
 	Before("", func() {
 		conn = s3.NewMockS3()
+		mockClock = s3.UseMockClock()
+		s3.MockMaxCopySize(0)
+		watchChanges = nil
+		s3.MockWatch(nil)
 		out = bytes.Buffer{}
+		stderr = bytes.Buffer{}
+		s3.MockStderr(&threadSafeWriter{Writer: &stderr})
+		s3.MockProgressInterval(0)
 		tempDir, _ = ioutil.TempDir("", "")
 		os.Chdir(tempDir)
+		// isolate from any user config
+		os.Setenv("S3_CONFIG_FILE", path.Join(tempDir, "s3config"))
 	})
 	After("", func() {
 		// Integration tests are mostly run against mock S3, but can be run
@@ -112,6 +277,18 @@ func init() {
 		if tempDir != "" {
 			os.RemoveAll(tempDir)
 		}
+		if server != nil {
+			server.Close()
+			server = nil
+		}
+		for name, value := range environ {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+		environ = map[string]*string{}
 	})
 
 	Given(`^I have bucket "(.+?)"$`, func(bucket string) {
@@ -121,6 +298,20 @@ func init() {
 		conn.CreateBucket(&input)
 	})
 
+	Given(`^I have a bucket "(.+?)" in region "(.+?)"$`, func(bucket string, region string) {
+		input := awss3.CreateBucketInput{
+			Bucket: aws.String(bucket),
+			CreateBucketConfiguration: &awss3.CreateBucketConfiguration{
+				LocationConstraint: aws.String(region),
+			},
+		}
+		conn.CreateBucket(&input)
+	})
+
+	Given(`^the location of bucket "(.+?)" is denied$`, func(bucket string) {
+		conn.(*s3.MockS3).FailNext("GetBucketLocation", bucket, "", 1)
+	})
+
 	Given(`^bucket "(.+?)" key "(.+?)" contains "(.+?)"$`, func(bucket string, key string, content string) {
 		body := bytes.NewReader([]byte(content))
 		input := awss3.PutObjectInput{
@@ -131,32 +322,285 @@ func init() {
 		conn.PutObject(&input)
 	})
 
+	Given(`^bucket "(.+?)" key "(.+?)" is a symlink to "(.+?)"$`, func(bucket string, key string, target string) {
+		conn.PutObject(&awss3.PutObjectInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			Body:     bytes.NewReader(nil),
+			Metadata: map[string]*string{"symlink": aws.String(target)},
+		})
+	})
+
+	Given(`^progress is logged every (\S+)$`, func(value string) {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			T.Errorf("Invalid interval: %s", value)
+		}
+		s3.MockProgressInterval(interval)
+	})
+
+	Given(`^objects larger than (\d+) bytes are copied in parts$`, func(size int64) {
+		s3.MockMaxCopySize(size)
+	})
+
+	Given(`^bucket "(.+?)" key "(.+?)" fails (\d+) times? on (\w+)$`, func(bucket string, key string, n int, operation string) {
+		conn.(*s3.MockS3).FailNext(operation, bucket, key, n)
+	})
+
+	Given(`^bucket "(.+?)" key "(.+?)" downloads are truncated (\d+) times?$`, func(bucket string, key string, n int) {
+		conn.(*s3.MockS3).FailNext("Truncate", bucket, key, n)
+	})
+
 	Given(`^local file "(.+?)" contains "(.+?)"$`, func(filename string, content string) {
-		// create containing directory if necessary
-		dirname := path.Dir(filename)
-		if dirname != "" {
-			if _, err := os.Stat(dirname); os.IsNotExist(err) {
-				err := os.MkdirAll(dirname, 0755)
+		createLocalFile(filename, content)
+	})
+
+	Given(`^local file "(.+?)" contains (\d+) bytes of "(.)"$`, func(filename string, size int, fill string) {
+		err := os.MkdirAll(path.Dir(filename), 0755)
+		if err != nil {
+			T.Errorf("Couldn't create directory: %s\n%s", path.Dir(filename), err)
+			return
+		}
+		err = ioutil.WriteFile(filename, bytes.Repeat([]byte(fill), size), 0644)
+		if err != nil {
+			T.Errorf("Couldn't create file: %s\n%s", filename, err)
+		}
+	})
+
+	Given(`^bucket "(.+?)" key "(.+?)" contains (\d+) bytes of "(.)" uploaded in (\d+) byte parts$`, func(bucket string, key string, size int, fill string, partSize int) {
+		content := bytes.Repeat([]byte(fill), size)
+		created, err := conn.CreateMultipartUpload(&awss3.CreateMultipartUploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			T.Errorf("Couldn't create upload: %s\n%s", key, err)
+			return
+		}
+		var parts []*awss3.CompletedPart
+		for n := int64(1); len(content) > 0; n++ {
+			part := content
+			if len(part) > partSize {
+				part = part[:partSize]
+			}
+			content = content[len(part):]
+			output, err := conn.UploadPart(&awss3.UploadPartInput{
+				Bucket:     aws.String(bucket),
+				Key:        aws.String(key),
+				UploadId:   created.UploadId,
+				PartNumber: aws.Int64(n),
+				Body:       bytes.NewReader(part),
+			})
+			if err != nil {
+				T.Errorf("Couldn't upload part: %s\n%s", key, err)
+				return
+			}
+			parts = append(parts, &awss3.CompletedPart{ETag: output.ETag, PartNumber: aws.Int64(n)})
+		}
+		_, err = conn.CompleteMultipartUpload(&awss3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(key),
+			UploadId:        created.UploadId,
+			MultipartUpload: &awss3.CompletedMultipartUpload{Parts: parts},
+		})
+		if err != nil {
+			T.Errorf("Couldn't complete upload: %s\n%s", key, err)
+		}
+	})
+
+	Given(`^bucket "(.+?)" key "(.+?)" has headers "(.+?)"$`, func(bucket string, key string, headers string) {
+		// replace the headers in place, keeping the user metadata
+		head, err := conn.HeadObject(&awss3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			T.Errorf("Couldn't head key: %s\n%s", key, err)
+			return
+		}
+		input := awss3.CopyObjectInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			CopySource:        aws.String(bucket + "/" + key),
+			MetadataDirective: aws.String(awss3.MetadataDirectiveReplace),
+			Metadata:          head.Metadata,
+		}
+		for _, line := range strings.Split(replacer.Replace(headers), "\n") {
+			parts := strings.SplitN(line, ": ", 2)
+			if len(parts) != 2 {
+				T.Errorf("Invalid header: %s", line)
+				return
+			}
+			value := aws.String(parts[1])
+			switch name := parts[0]; name {
+			case "Cache-Control":
+				input.CacheControl = value
+			case "Content-Disposition":
+				input.ContentDisposition = value
+			case "Content-Encoding":
+				input.ContentEncoding = value
+			case "Content-Language":
+				input.ContentLanguage = value
+			case "Content-Type":
+				input.ContentType = value
+			case "Expires":
+				t, err := http.ParseTime(parts[1])
 				if err != nil {
-					T.Errorf("Couldn't create directory: %s\n%s", dirname, err)
+					T.Errorf("Invalid time: %s\n%s", parts[1], err)
 					return
 				}
+				input.Expires = &t
+			case "Storage-Class":
+				input.StorageClass = value
+			default:
+				input.Metadata[strings.TrimPrefix(name, "X-Amz-Meta-")] = value
 			}
 		}
+		_, err = conn.CopyObject(&input)
+		if err != nil {
+			T.Errorf("Couldn't set headers: %s\n%s", key, err)
+		}
+	})
 
-		file, err := os.Create(filename)
+	Given(`^bucket "(.+?)" key "(.+?)" has an upload in progress$`, func(bucket string, key string) {
+		_, err := conn.CreateMultipartUpload(&awss3.CreateMultipartUploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
 		if err != nil {
-			T.Errorf("Couldn't create file: %s\n%s", filename, err)
+			T.Errorf("Couldn't create upload: %s\n%s", key, err)
+		}
+	})
+
+	Given(`^local file "(.+?)" is deleted$`, func(filename string) {
+		if err := os.Remove(filename); err != nil {
+			T.Errorf("Couldn't delete file: %s\n%s", filename, err)
+		}
+	})
+
+	Given(`^local file "(.+?)" was modified at "(.+?)"$`, func(filename string, value string) {
+		mtime, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			T.Errorf("Invalid time: %s\n%s", value, err)
 			return
 		}
-		defer file.Close()
-		file.WriteString(content)
+		err = os.Chtimes(filename, mtime, mtime)
+		if err != nil {
+			T.Errorf("Couldn't set modification time: %s\n%s", filename, err)
+		}
+	})
+
+	Given(`^local file "(.+?)" has permissions "(.+?)"$`, func(filename string, value string) {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			T.Errorf("Invalid mode: %s\n%s", value, err)
+			return
+		}
+		err = os.Chmod(filename, os.FileMode(mode))
+		if err != nil {
+			T.Errorf("Couldn't set mode: %s\n%s", filename, err)
+		}
+	})
+
+	Given(`^the s3 config file contains "(.+?)"$`, func(content string) {
+		err := ioutil.WriteFile(os.Getenv("S3_CONFIG_FILE"), []byte(replacer.Replace(content)), 0644)
+		if err != nil {
+			T.Errorf("Couldn't create config file:\n%s", err)
+		}
+	})
+
+	Given(`^local symlink "(.+?)" points to "(.+?)"$`, func(filename string, target string) {
+		err := os.Symlink(target, filename)
+		if err != nil {
+			T.Errorf("Couldn't create symlink: %s\n%s", filename, err)
+		}
+	})
+
+	Given(`^an S3 compatible server$`, func() {
+		startServer(false)
+	})
+
+	Given(`^an S3 compatible server with a self-signed certificate$`, func() {
+		startServer(true)
+	})
+
+	Given(`^the server has key "(.+?)" with contents "(.+?)"$`, func(key string, content string) {
+		server.Put(key, content)
+	})
+
+	Given(`^the environment variable "(.+?)" is "(.*?)"$`, func(name string, value string) {
+		value = strings.Replace(value, "SERVER", server.URL, -1)
+		setenv(name, &value)
+	})
+
+	Given(`^while watching local file "(.+?)" changes to "(.+?)"$`, func(filename string, content string) {
+		watching(func(root string, events chan<- string) {
+			createLocalFile(filename, content)
+			events <- filename
+		})
+	})
+
+	Given(`^while watching local file "(.+?)" changes unnoticed to "(.+?)"$`, func(filename string, content string) {
+		watching(func(root string, events chan<- string) {
+			createLocalFile(filename, content)
+		})
+	})
+
+	Given(`^while watching local file "(.+?)" is deleted$`, func(filename string) {
+		watching(func(root string, events chan<- string) {
+			os.Remove(filename)
+			events <- filename
+		})
+	})
+
+	Given(`^while watching the events overflow$`, func() {
+		watching(func(root string, events chan<- string) {
+			// as sent on overflow, to resync everything
+			events <- root
+		})
+	})
+
+	Given(`^while watching bucket "(.+?)" key "(.+?)" is synced with contents "(.+?)"$`, func(bucket string, key string, exp string) {
+		watching(func(root string, events chan<- string) {
+			for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+				output, err := conn.GetObject(&awss3.GetObjectInput{
+					Bucket: aws.String(bucket),
+					Key:    aws.String(key),
+				})
+				if err == nil {
+					content, _ := ioutil.ReadAll(output.Body)
+					if string(content) == exp {
+						return
+					}
+				}
+			}
+			T.Errorf("%s Key %s was not synced", bucket, key)
+		})
+	})
+
+	Given(`^while watching the output contains "(.+?)"$`, func(exp string) {
+		watching(func(root string, events chan<- string) {
+			exp = replacer.Replace(exp)
+			for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+				written.Lock()
+				act := out.String()
+				written.Unlock()
+				if strings.Contains(act, exp) {
+					return
+				}
+			}
+			T.Errorf("Output was not written while watching: %q", exp)
+		})
 	})
 
 	When(`^I run "(.+?)"$`, func(s1 string) {
 		args := strings.Split(s1, " ")
-		o := threadSafeWriter{&out, sync.Mutex{}}
-		lastExitCode = s3.Main(conn, args, &o)
+		lastExitCode = s3.Main(conn, args, &written)
+	})
+
+	When(`^I run "(.+?)" against the server$`, func(s1 string) {
+		args := strings.Split(strings.Replace(s1, "SERVER", server.URL, -1), " ")
+		lastExitCode = s3.Main(nil, args, &written)
 	})
 
 	Then(`^local file "(.+?)" has contents "(.+?)"$`, func(filename string, exp string) {
@@ -172,11 +616,126 @@ func init() {
 			return
 		}
 		act := string(content)
+		exp = replacer.Replace(exp)
 		if act != exp {
 			T.Errorf("%s contents expected:\n%s\ngot:\n%s", filename, exp, act)
 		}
 	})
 
+	Then(`^local file "(.+?)" (includes|does not include) "(.+?)"$`, func(filename string, includes string, exp string) {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			T.Errorf("Local file error:\n%s", err)
+			return
+		}
+		exp = replacer.Replace(exp)
+		if strings.Contains(string(content), exp) != (includes == "includes") {
+			T.Errorf("%s expected to %s %q, got:\n%s", filename, strings.TrimSuffix(includes, "s"), exp, content)
+		}
+	})
+
+	Then(`^local file "(.+?)" exists$`, func(filename string) {
+		if _, err := os.Stat(filename); err != nil {
+			T.Errorf("Local file %s does not exist", filename)
+		}
+	})
+
+	Then(`^local file "(.+?)" was last modified at "(.+?)"$`, func(filename string, value string) {
+		exp, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			T.Errorf("Invalid time: %s\n%s", value, err)
+			return
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			T.Errorf("Local file error:\n%s", err)
+			return
+		}
+		if !info.ModTime().Equal(exp) {
+			T.Errorf("%s modification time expected:\n%s\ngot:\n%s", filename, exp, info.ModTime())
+		}
+	})
+
+	Then(`^local file "(.+?)" has mode "(.+?)"$`, func(filename string, exp string) {
+		info, err := os.Stat(filename)
+		if err != nil {
+			T.Errorf("Local file error:\n%s", err)
+			return
+		}
+		act := fmt.Sprintf("%04o", info.Mode().Perm())
+		if act != exp {
+			T.Errorf("%s mode expected:\n%s\ngot:\n%s", filename, exp, act)
+		}
+	})
+
+	Then(`^local file "(.+?)" links to "(.+?)"$`, func(filename string, exp string) {
+		act, err := os.Readlink(filename)
+		if err != nil {
+			T.Errorf("Local file error:\n%s", err)
+			return
+		}
+		if act != exp {
+			T.Errorf("%s link expected:\n%s\ngot:\n%s", filename, exp, act)
+		}
+	})
+
+	Then(`^local file "(.+?)" does not exist$`, func(filename string) {
+		if _, err := os.Lstat(filename); err == nil {
+			T.Errorf("Local file %s exists", filename)
+		}
+	})
+
+	Then(`^local file "(.+?)" is not a link$`, func(filename string) {
+		fi, err := os.Lstat(filename)
+		if err != nil {
+			T.Errorf("Local file error:\n%s", err)
+			return
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			T.Errorf("Local file %s is a link", filename)
+		}
+	})
+
+	Then(`^a connection was made to region "(.+?)"$`, func(region string) {
+		connections := conn.(*s3.MockS3).Connections()
+		for _, r := range connections {
+			if r == region {
+				return
+			}
+		}
+		T.Errorf("Connection to region %s expected, got: %q", region, connections)
+	})
+
+	Then(`^the region of a bucket was looked up (\d+) times?$`, func(exp int) {
+		act := conn.(*s3.MockS3).Requests("GetBucketLocation", "HeadBucket")
+		if act != exp {
+			T.Errorf("Region lookups expected: %d, got: %d", exp, act)
+		}
+	})
+
+	Then(`^the server received "(.+?)"$`, func(exp string) {
+		requests := server.Requests()
+		for _, r := range requests {
+			if r == exp {
+				return
+			}
+		}
+		T.Errorf("Request %s expected, got: %q", exp, requests)
+	})
+
+	Then(`^the server received (signed|unsigned) requests$`, func(kind string) {
+		if !server.Signed(kind == "signed") {
+			T.Errorf("Requests expected to be %s", kind)
+		}
+	})
+
+	Then(`^there were (\d+) (\w+) requests?$`, func(exp int, operation string) {
+		act := conn.(*s3.MockS3).Requests(operation)
+		if act != exp {
+			T.Errorf("%s requests expected: %d, got: %d", operation, exp, act)
+		}
+	})
+
 	Then(`^the output is "(.*?)"$`, func(exp string) {
 		// replace newlines
 		exp = replacer.Replace(exp)
@@ -186,6 +745,14 @@ func init() {
 		}
 	})
 
+	Then(`^the output contains "(.*?)" (\d+) times?$`, func(exp string, n int) {
+		exp = replacer.Replace(exp)
+		act := strings.Count(out.String(), exp)
+		if act != n {
+			T.Errorf("Output expected to contain %q %d times, got %d times:\n%s", exp, n, act, out.String())
+		}
+	})
+
 	Then(`^the output contains "(.*?)"$`, func(exp string) {
 		// replace newlines
 		exp = replacer.Replace(exp)
@@ -195,12 +762,39 @@ func init() {
 		}
 	})
 
+	Then(`^stderr contains "(.*?)"$`, func(exp string) {
+		exp = replacer.Replace(exp)
+		if !strings.Contains(stderr.String(), exp) {
+			T.Errorf("Stderr expected to contain:\n%s\ngot:\n%s", exp, stderr.String())
+		}
+	})
+
+	Then(`^the output does not contain "(.*?)"$`, func(exp string) {
+		exp = replacer.Replace(exp)
+		act := string(out.Bytes())
+		if strings.Contains(act, exp) {
+			T.Errorf("Output contains:\n%s\ngot:\n%s", exp, act)
+		}
+	})
+
 	Then(`^the exit code is (\d+?)$`, func(code int) {
 		if code != lastExitCode {
 			T.Errorf("Exit code expected:\n%d\ngot:\n%d", code, lastExitCode)
 		}
 	})
 
+	Then(`^it was slowed by at least (\S+)$`, func(value string) {
+		min, err := time.ParseDuration(value)
+		if err != nil {
+			T.Errorf("Invalid duration: %s\n%s", value, err)
+			return
+		}
+		act := mockClock.Elapsed()
+		if act < min {
+			T.Errorf("Delay expected at least:\n%s\ngot:\n%s", min, act)
+		}
+	})
+
 	Then(`^the bucket "(.+?)" exists$`, func(bucket string) {
 		if !bucketExists(bucket) {
 			T.Errorf("Bucket %s does not exist", bucket)
@@ -235,6 +829,84 @@ func init() {
 		}
 	})
 
+	Then(`^bucket "(.+?)" has key "(.+?)" with (\d+) bytes of "(.)"$`, func(bucket string, key string, size int, fill string) {
+		input := awss3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		output, err := conn.GetObject(&input)
+		if err != nil {
+			T.Errorf("Bucket %s Key %s error:\n%s", bucket, key, err)
+			return
+		}
+		content, err := ioutil.ReadAll(output.Body)
+		if err != nil {
+			T.Errorf("Bucket %s Key %s error:\n%s", bucket, key, err)
+			return
+		}
+		if !bytes.Equal(content, bytes.Repeat([]byte(fill), size)) {
+			T.Errorf("%s Key %s contents expected %d bytes of %s", bucket, key, size, fill)
+		}
+	})
+
+	Then(`^bucket "(.+?)" key "(.+?)" has metadata "(.+?)" with value "(.+?)"$`, func(bucket string, key string, name string, exp string) {
+		input := awss3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		output, err := conn.HeadObject(&input)
+		if err != nil {
+			T.Errorf("Bucket %s Key %s error:\n%s", bucket, key, err)
+			return
+		}
+		act := ""
+		for k, v := range output.Metadata {
+			if strings.EqualFold(k, name) {
+				act = *v
+			}
+		}
+		if act != exp {
+			T.Errorf("%s Key %s metadata %s expected:\n%s\ngot:\n%s", bucket, key, name, exp, act)
+		}
+	})
+
+	Then(`^bucket "(.+?)" key "(.+?)" has header "(.+?)" with value "(.+?)"$`, func(bucket string, key string, name string, exp string) {
+		output, err := conn.HeadObject(&awss3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			T.Errorf("Bucket %s Key %s error:\n%s", bucket, key, err)
+			return
+		}
+		headers := map[string]*string{
+			"Cache-Control":       output.CacheControl,
+			"Content-Disposition": output.ContentDisposition,
+			"Content-Encoding":    output.ContentEncoding,
+			"Content-Language":    output.ContentLanguage,
+			"Content-Type":        output.ContentType,
+			"Expires":             output.Expires,
+			"Storage-Class":       output.StorageClass,
+		}
+		act := aws.StringValue(headers[name])
+		if act != exp {
+			T.Errorf("%s Key %s header %s expected:\n%s\ngot:\n%s", bucket, key, name, exp, act)
+		}
+	})
+
+	Then(`^bucket "(.+?)" has (\d+) uploads? in progress$`, func(bucket string, exp int) {
+		output, err := conn.ListMultipartUploads(&awss3.ListMultipartUploadsInput{
+			Bucket: aws.String(bucket),
+		})
+		if err != nil {
+			T.Errorf("Bucket %s error:\n%s", bucket, err)
+			return
+		}
+		if act := len(output.Uploads); act != exp {
+			T.Errorf("Bucket %s uploads in progress expected: %d got: %d", bucket, exp, act)
+		}
+	})
+
 	Then(`^bucket "(.+?)" key "(.+?)" exists$`, func(bucket string, key string) {
 		input := awss3.GetObjectInput{
 			Bucket: aws.String(bucket),
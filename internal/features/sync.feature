@@ -11,7 +11,7 @@ Feature: sync command
     Then bucket "s3.barnybug.github.com" has key "banana" with contents "BANANA"
     And the output contains "U apple\n"
     And the output contains "A banana\n"
-    And the output contains "1 added 0 deleted 1 updated 0 unchanged\n"
+    And the output contains "1 added 0 deleted 1 updated 0 unchanged 0 failed\n"
 
   Scenario: I can sync local to S3 deletes
     Given I have bucket "s3.barnybug.github.com"
@@ -21,7 +21,7 @@ Feature: sync command
     Then bucket "s3.barnybug.github.com" has key "apple" with contents "APPLE"
     And the output contains "A apple\n"
     And the output contains "D banana\n"
-    And the output contains "1 added 1 deleted 0 updated 0 unchanged\n"
+    And the output contains "1 added 1 deleted 0 updated 0 unchanged 0 failed\n"
 
   Scenario: I can sync S3 to local
     Given I have bucket "s3.barnybug.github.com"
@@ -32,7 +32,7 @@ Feature: sync command
     Then local file "folder1/banana" has contents "BANANA"
     And the output contains "A apple\n"
     And the output contains "A banana\n"
-    And the output contains "2 added 0 deleted 0 updated 0 unchanged\n"
+    And the output contains "2 added 0 deleted 0 updated 0 unchanged 0 failed\n"
 
   Scenario: I can sync S3 to S3
     Given I have bucket "s3.barnybug.github.com"
@@ -45,7 +45,84 @@ Feature: sync command
     And bucket "s3b.barnybug.github.com" has key "banana" with contents "BANANA"
     And the output contains "A apple\n"
     And the output contains "U banana\n"
-    And the output contains "1 added 0 deleted 1 updated 0 unchanged\n"
+    And the output contains "1 added 0 deleted 1 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync S3 to S3 copies large keys in parts
+    Given I have bucket "s3.barnybug.github.com"
+    And I have bucket "s3b.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "big" contains 12582912 bytes of "x" uploaded in 5242880 byte parts
+    And objects larger than 1048576 bytes are copied in parts
+    When I run "s3 sync s3://s3.barnybug.github.com/ s3://s3b.barnybug.github.com/"
+    Then bucket "s3b.barnybug.github.com" has key "big" with 12582912 bytes of "x"
+    And there were 3 UploadPartCopy requests
+    And bucket "s3b.barnybug.github.com" has 0 uploads in progress
+    And the output contains "1 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync S3 to S3 aborts a copy in parts that fails
+    Given I have bucket "s3.barnybug.github.com"
+    And I have bucket "s3b.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "big" contains 12582912 bytes of "x" uploaded in 5242880 byte parts
+    And objects larger than 1048576 bytes are copied in parts
+    And bucket "s3b.barnybug.github.com" key "big" fails 1 time on UploadPartCopy
+    When I run "s3 --retries 0 sync s3://s3.barnybug.github.com/ s3://s3b.barnybug.github.com/"
+    Then the exit code is 1
+    And bucket "s3b.barnybug.github.com" key "big" does not exist
+    And bucket "s3b.barnybug.github.com" has 0 uploads in progress
+    And the output contains "E big: SlowDown"
+
+  Scenario: sync S3 to S3 copies keys with their metadata
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/small" contains "SMALL"
+    And local file "src/big" contains 6000000 bytes of "x"
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/a/"
+    And I run "s3 sync s3://s3.barnybug.github.com/a/ s3://s3.barnybug.github.com/b/"
+    And I run "s3 sync s3://s3.barnybug.github.com/a/ s3://s3.barnybug.github.com/b/"
+    Then bucket "s3.barnybug.github.com" has key "b/small" with contents "SMALL"
+    And bucket "s3.barnybug.github.com" key "b/big" exists
+    And the output contains "0 added 0 deleted 0 updated 2 unchanged 0 failed\n"
+
+  Scenario: sync records and restores modification times and modes
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "src/a" was modified at "2016-01-02T03:04:05Z"
+    And local file "src/a" has permissions "0600"
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/"
+    And I run "s3 sync s3://s3.barnybug.github.com/ dest/"
+    Then bucket "s3.barnybug.github.com" key "a" has metadata "mtime" with value "2016-01-02T03:04:05Z"
+    And bucket "s3.barnybug.github.com" key "a" has metadata "mode" with value "0600"
+    And local file "dest/a" was last modified at "2016-01-02T03:04:05Z"
+    And local file "dest/a" has mode "0600"
+
+  Scenario: sync S3 to S3 keeps user metadata
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "src/a" was modified at "2016-01-02T03:04:05Z"
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/a/"
+    And I run "s3 sync s3://s3.barnybug.github.com/a/ s3://s3.barnybug.github.com/b/"
+    Then bucket "s3.barnybug.github.com" key "b/a" has metadata "mtime" with value "2016-01-02T03:04:05Z"
+
+  Scenario: sync --mtime does not download restored files again
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "src/a" was modified at "2016-01-02T03:04:05Z"
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/"
+    And I run "s3 sync --mtime s3://s3.barnybug.github.com/ dest/"
+    And I run "s3 sync --mtime s3://s3.barnybug.github.com/ dest/"
+    Then the output contains "0 added 0 deleted 0 updated 1 unchanged 0 failed\n"
+    And there were 0 HeadObject requests
+
+  Scenario: sync --mtime downloads files updated since they were downloaded
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "src/a" was modified at "2016-01-02T03:04:05Z"
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/"
+    And I run "s3 sync --mtime s3://s3.barnybug.github.com/ dest/"
+    And local file "src/a" contains "B"
+    And local file "src/a" was modified at "2016-01-03T03:04:05Z"
+    And I run "s3 sync src/ s3://s3.barnybug.github.com/"
+    And I run "s3 sync --mtime s3://s3.barnybug.github.com/ dest/"
+    Then local file "dest/a" has contents "B"
+    And local file "dest/a" was last modified at "2016-01-03T03:04:05Z"
 
   Scenario: sync needs 2 parameters
     When I run "s3 sync s3://s3.barnybug.github.com/"
@@ -64,3 +141,594 @@ Feature: sync command
     Given I have bucket "s3.barnybug.github.com"
     When I run "s3 sync s3://s3.barnybug.github.com/ s3://s3b.barnybug.github.com/"
     Then the exit code is 1
+
+  Scenario: sync compares checksums by default
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "ORANG"
+    And local file "apple" contains "APPLE"
+    When I run "s3 sync . s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "apple" with contents "APPLE"
+    And the output contains "U apple\n"
+
+  Scenario: sync with --size-only ignores content changes
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "ORANG"
+    And local file "apple" contains "APPLE"
+    When I run "s3 sync --size-only . s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "apple" with contents "ORANG"
+    And the output contains "0 added 0 deleted 0 updated 1 unchanged 0 failed\n"
+
+  Scenario: sync with --mtime updates files modified since upload
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "ORANG"
+    And bucket "s3.barnybug.github.com" key "banana" contains "BANAN"
+    And local file "apple" contains "APPLE"
+    And local file "apple" was modified at "2001-01-01T00:00:00Z"
+    And local file "banana" contains "BANANA"
+    When I run "s3 sync --mtime . s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "apple" with contents "ORANG"
+    And bucket "s3.barnybug.github.com" has key "banana" with contents "BANANA"
+    And the output contains "0 added 0 deleted 1 updated 1 unchanged 0 failed\n"
+
+  Scenario: sync with --newer never overwrites newer destination files
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "orange"
+    And local file "apple" contains "APPLE"
+    And local file "apple" was modified at "2001-01-01T00:00:00Z"
+    When I run "s3 sync --newer . s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "apple" with contents "orange"
+    And the output contains "0 added 0 deleted 0 updated 1 unchanged 0 failed\n"
+
+  Scenario: sync comparison options are exclusive
+    When I run "s3 sync --size-only --mtime . s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+
+  Scenario: sync does not re-upload unchanged multipart uploads
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "big" contains 6000000 bytes of "a"
+    When I run "s3 sync . s3://s3.barnybug.github.com/"
+    And I run "s3 sync . s3://s3.barnybug.github.com/"
+    Then the output contains "A big\n"
+    And the output contains "0 added 0 deleted 0 updated 1 unchanged 0 failed\n"
+
+  Scenario: sync compares multipart etags without metadata
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "big" contains 6000000 bytes of "a" uploaded in 5242880 byte parts
+    And bucket "s3.barnybug.github.com" key "other" contains 6000000 bytes of "a" uploaded in 5242880 byte parts
+    And local file "big" contains 6000000 bytes of "a"
+    And local file "other" contains 6000000 bytes of "b"
+    When I run "s3 sync . s3://s3.barnybug.github.com/"
+    Then the output contains "U other\n"
+    And the output contains "0 added 0 deleted 1 updated 1 unchanged 0 failed\n"
+
+  Scenario: sync fails only the files that can't be compared
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "big" contains 6291456 bytes of "x" uploaded in 5242880 byte parts
+    And bucket "s3.barnybug.github.com" key "big" fails 1 time on HeadObject
+    And local file "src/big" contains 6291456 bytes of "x"
+    And local file "src/new" contains "NEW"
+    When I run "s3 --retries 0 sync src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And the output contains "E big: NotFound"
+    And the output contains "1 added 0 deleted 0 updated 0 unchanged 1 failed\n"
+    And bucket "s3.barnybug.github.com" has key "new" with contents "NEW"
+
+  Scenario: sync caches local checksums
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "APPLE"
+    And local file "src/apple" contains "APPLE"
+    When I run "s3 sync --checksum-cache cache/md5 src/ s3://s3.barnybug.github.com/"
+    And I run "s3 sync --checksum-cache cache/md5 src/ s3://s3.barnybug.github.com/"
+    Then local file "cache/md5" exists
+    And the output contains "0 added 0 deleted 0 updated 1 unchanged 0 failed\n"
+
+  Scenario: sync drops cached checksums of deleted and changed files
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "APPLE"
+    And bucket "s3.barnybug.github.com" key "banana" contains "BANANA"
+    And bucket "s3.barnybug.github.com" key "cherry" contains "CHERRY"
+    And bucket "s3.barnybug.github.com" key "other/damson" contains "DAMSON"
+    And local file "src/apple" contains "APPLE"
+    And local file "src/banana" contains "BANANA"
+    And local file "src/cherry" contains "CHERRY"
+    And local file "other/damson" contains "DAMSON"
+    When I run "s3 sync --checksum-cache cache/md5 src/ s3://s3.barnybug.github.com/"
+    And I run "s3 sync --checksum-cache cache/md5 other/ s3://s3.barnybug.github.com/other/"
+    Then local file "cache/md5" includes "/src/banana\""
+    And local file "cache/md5" includes "/src/cherry\""
+
+    Given local file "src/banana" is deleted
+    And local file "src/cherry" contains "CHERRIES"
+    When I run "s3 sync --size-only --checksum-cache cache/md5 src/ s3://s3.barnybug.github.com/"
+    Then local file "cache/md5" includes "/src/apple\""
+    And local file "cache/md5" does not include "/src/banana\""
+    And local file "cache/md5" does not include "/src/cherry\""
+    And local file "cache/md5" includes "/other/damson\""
+
+  Scenario: sync --delete does not remove excluded files
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "banana" contains "BANANA"
+    And bucket "s3.barnybug.github.com" key "cache/data" contains "DATA"
+    And local file "src/apple" contains "APPLE"
+    And local file "src/build.o" contains "OBJECT"
+    When I run "s3 sync --delete --exclude *.o --exclude cache/ src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" key "cache/data" exists
+    And bucket "s3.barnybug.github.com" key "build.o" does not exist
+    And the output contains "1 added 1 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync honours .s3ignore files
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/.s3ignore" contains "*.log\n!keep.log\nbuild/\n/top.txt\n"
+    And local file "src/a.log" contains "A"
+    And local file "src/keep.log" contains "KEEP"
+    And local file "src/build/out" contains "OUT"
+    And local file "src/top.txt" contains "TOP"
+    And local file "src/sub/top.txt" contains "SUBTOP"
+    And local file "src/sub/build" contains "BUILD"
+    And local file "src/sub/.s3ignore" contains "!b.log"
+    And local file "src/sub/b.log" contains "B"
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" key "keep.log" exists
+    And bucket "s3.barnybug.github.com" key "sub/top.txt" exists
+    And bucket "s3.barnybug.github.com" key "sub/build" exists
+    And bucket "s3.barnybug.github.com" key "sub/b.log" exists
+    And bucket "s3.barnybug.github.com" key "a.log" does not exist
+    And bucket "s3.barnybug.github.com" key "build/out" does not exist
+    And bucket "s3.barnybug.github.com" key "top.txt" does not exist
+    And the output contains "6 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync --gitignore honours .gitignore files
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/.gitignore" contains "*.tmp"
+    And local file "src/.git/config" contains "CONFIG"
+    And local file "src/x.tmp" contains "X"
+    And local file "src/y" contains "Y"
+    When I run "s3 sync --gitignore src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" key "y" exists
+    And bucket "s3.barnybug.github.com" key "x.tmp" does not exist
+    And bucket "s3.barnybug.github.com" key ".git/config" does not exist
+    And the output contains "2 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync --watch requires a local source
+    Given I have bucket "s3.barnybug.github.com"
+    When I run "s3 sync --watch s3://s3.barnybug.github.com/ folder1"
+    Then the exit code is 1
+
+  Scenario: sync --watch syncs changes together once they settle
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "1"
+    And while watching local file "src/a" changes to "22"
+    And while watching local file "src/a" changes to "333"
+    And while watching local file "src/b" changes to "B"
+    When I run "s3 sync --watch --watch-delay 1h src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "a" with contents "333"
+    And bucket "s3.barnybug.github.com" has key "b" with contents "B"
+    And the output contains "U a\n" 1 time
+
+  Scenario: sync --watch syncs each batch of changes after they settle
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/b" contains "B"
+    And while watching local file "src/a" changes to "1"
+    And while watching bucket "s3.barnybug.github.com" key "a" is synced with contents "1"
+    And while watching local file "src/a" changes to "22"
+    When I run "s3 sync --watch --watch-delay 1ms src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "a" with contents "22"
+    And the output contains "A a\n" 1 time
+    And the output contains "U a\n" 1 time
+
+  Scenario: sync --watch syncs only the changed files
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "src/b" contains "B"
+    And local file "src/d" contains "D"
+    And while watching local file "src/a" changes to "AA"
+    And while watching local file "src/b" is deleted
+    And while watching local file "src/c" changes to "C"
+    And while watching local file "src/d" changes unnoticed to "DD"
+    When I run "s3 sync --watch --delete --watch-delay 1ms src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "a" with contents "AA"
+    And bucket "s3.barnybug.github.com" key "b" does not exist
+    And bucket "s3.barnybug.github.com" has key "c" with contents "C"
+    And bucket "s3.barnybug.github.com" has key "d" with contents "D"
+
+  Scenario: sync --watch resyncs everything when events overflow
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And while watching local file "src/a" changes unnoticed to "AA"
+    And while watching local file "src/b" changes unnoticed to "B"
+    And while watching the events overflow
+    When I run "s3 sync --watch --watch-delay 1ms src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "a" with contents "AA"
+    And bucket "s3.barnybug.github.com" has key "b" with contents "B"
+
+  Scenario: sync --watch limits deletes to a percentage of the whole destination
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "src/b" contains "B"
+    And local file "src/c" contains "C"
+    And local file "src/d" contains "D"
+    And while watching local file "src/a" is deleted
+    When I run "s3 sync --watch --delete --max-delete-percent 30 --watch-delay 1ms src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" key "a" does not exist
+    And bucket "s3.barnybug.github.com" has key "b" with contents "B"
+
+  Scenario: sync --journal removes the journal once finished
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/small" contains "SMALL"
+    And local file "src/big" contains 6000000 bytes of "x"
+    When I run "s3 sync --journal sync.journal src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" key "big" exists
+    And bucket "s3.barnybug.github.com" key "small" exists
+    And local file "sync.journal" does not exist
+    And the output contains "2 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync --journal skips files already synced
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "a" contains "B"
+    And local file "src/a" contains "A"
+    And local file "src/a" was modified at "2016-01-01T00:00:00Z"
+    And local file "sync.journal" contains "{"source":"src/","destination":"s3://s3.barnybug.github.com/"}\n{"action":"update","path":"a","size":1,"mtime":1451606400000000000}\n"
+    When I run "s3 sync --journal sync.journal src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "a" with contents "B"
+    And the output contains "0 added 0 deleted 0 updated 1 unchanged 0 failed\n"
+
+  Scenario: sync --journal aborts an upload that can't be resumed
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "big" has an upload in progress
+    And local file "src/big" contains 6000000 bytes of "x"
+    And local file "src/big" was modified at "2016-01-01T00:00:00Z"
+    And local file "sync.journal" contains "{"source":"src/","destination":"s3://s3.barnybug.github.com/"}\n{"key":"s3.barnybug.github.com/big","upload_id":"upload1","size":5000000,"mtime":1451606400000000000,"part_size":5242880}\n"
+    When I run "s3 sync --journal sync.journal src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 0
+    And bucket "s3.barnybug.github.com" key "big" exists
+    And bucket "s3.barnybug.github.com" has 0 uploads in progress
+
+  Scenario: sync --journal keeps a failed upload to resume
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/big" contains 6000000 bytes of "x"
+    And bucket "s3.barnybug.github.com" key "big" fails 1 time on UploadPart
+    When I run "s3 --retries 0 sync --journal sync.journal src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And local file "sync.journal" exists
+    And bucket "s3.barnybug.github.com" has 1 upload in progress
+
+  Scenario: sync --journal resumes a failed upload
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/big" contains 16000000 bytes of "x"
+    And bucket "s3.barnybug.github.com" key "big" fails 1 time on UploadPart
+    When I run "s3 --retries 0 sync --journal sync.journal src/ s3://s3.barnybug.github.com/"
+    And I run "s3 sync --journal sync.journal src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 0
+    And bucket "s3.barnybug.github.com" has key "big" with 16000000 bytes of "x"
+    And bucket "s3.barnybug.github.com" has 0 uploads in progress
+
+  Scenario: sync --journal aborts failed uploads when the journal is removed
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/big" contains 6000000 bytes of "x"
+    And bucket "s3.barnybug.github.com" key "big" fails 1 time on UploadPart
+    When I run "s3 --retries 0 --ignore-errors sync --journal sync.journal src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 0
+    And local file "sync.journal" does not exist
+    And bucket "s3.barnybug.github.com" has 0 uploads in progress
+
+  Scenario: sync --journal refuses a journal for another sync
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local file "sync.journal" contains "{"source":"other/","destination":"s3://s3.barnybug.github.com/"}\n"
+    When I run "s3 sync --journal sync.journal src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And bucket "s3.barnybug.github.com" key "a" does not exist
+
+  Scenario: sync --backup-prefix copies overwritten and deleted keys
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "dest/a" contains "OLD A"
+    And bucket "s3.barnybug.github.com" key "dest/b" contains "B"
+    And bucket "s3.barnybug.github.com" key "dest/c" contains "C"
+    And local file "src/a" contains "NEW A"
+    And local file "src/b" contains "B"
+    When I run "s3 sync --delete --backup-prefix s3://s3.barnybug.github.com/trash src/ s3://s3.barnybug.github.com/dest/"
+    Then bucket "s3.barnybug.github.com" has key "dest/a" with contents "NEW A"
+    And bucket "s3.barnybug.github.com" has key "trash/a" with contents "OLD A"
+    And bucket "s3.barnybug.github.com" has key "trash/c" with contents "C"
+    And bucket "s3.barnybug.github.com" key "dest/c" does not exist
+    And bucket "s3.barnybug.github.com" key "trash/b" does not exist
+
+  Scenario: sync --backup-prefix to a local directory
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "a" contains "NEW A"
+    And local file "dest/a" contains "OLD A"
+    And local file "dest/c" contains "C"
+    When I run "s3 sync --delete --backup-prefix trash s3://s3.barnybug.github.com/ dest/"
+    Then local file "dest/a" has contents "NEW A"
+    And local file "trash/a" has contents "OLD A"
+    And local file "trash/c" has contents "C"
+    And local file "dest/c" does not exist
+
+  Scenario: sync follows symlinks by default, skipping loops
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/dir/a" contains "A"
+    And local file "other/b" contains "B"
+    And local symlink "src/link" points to "dir/a"
+    And local symlink "src/other" points to "../other"
+    And local symlink "src/dir/loop" points to ".."
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "link" with contents "A"
+    And bucket "s3.barnybug.github.com" has key "other/b" with contents "B"
+    And bucket "s3.barnybug.github.com" key "dir/loop/dir/a" does not exist
+    And the output contains "3 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync --links skip ignores symlinks
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local symlink "src/link" points to "a"
+    When I run "s3 sync --links skip src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" key "link" does not exist
+    And the output contains "1 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync --links preserve stores and recreates symlinks
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And local symlink "src/link" points to "a"
+    When I run "s3 sync --links preserve src/ s3://s3.barnybug.github.com/"
+    And I run "s3 sync --links preserve s3://s3.barnybug.github.com/ dest/"
+    Then bucket "s3.barnybug.github.com" key "link" has metadata "symlink" with value "a"
+    And local file "dest/link" links to "a"
+    And local file "dest/a" has contents "A"
+
+  Scenario: sync --links preserve refuses downloaded symlinks leaving the destination
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "home" is a symlink to "/tmp"
+    And bucket "s3.barnybug.github.com" key "up" is a symlink to "../src"
+    And bucket "s3.barnybug.github.com" key "home/file" contains "F"
+    When I run "s3 sync --links preserve s3://s3.barnybug.github.com/ dest/"
+    Then the exit code is 1
+    And local file "dest/home" is not a link
+    And local file "dest/up" does not exist
+
+  Scenario: sync downloads symlinks preserved in metadata as files by default
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "link" is a symlink to "a"
+    When I run "s3 sync s3://s3.barnybug.github.com/ dest/"
+    Then the exit code is 0
+    And local file "dest/link" is not a link
+
+  Scenario: sync --links must be follow, skip or preserve
+    When I run "s3 sync --links copy src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+
+  Scenario: sync --max-delete aborts before changing anything
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "b" contains "B"
+    And bucket "s3.barnybug.github.com" key "c" contains "C"
+    And local file "src/a" contains "A"
+    When I run "s3 sync --delete --max-delete 1 src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And bucket "s3.barnybug.github.com" key "a" does not exist
+    And bucket "s3.barnybug.github.com" key "b" exists
+    And bucket "s3.barnybug.github.com" key "c" exists
+
+  Scenario: sync --max-delete allows deletes within the limit
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "b" contains "B"
+    And local file "src/a" contains "A"
+    When I run "s3 sync --delete --max-delete 1 src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" key "a" exists
+    And bucket "s3.barnybug.github.com" key "b" does not exist
+    And the output contains "1 added 1 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync --max-delete-percent aborts before changing anything
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "a" contains "A"
+    And bucket "s3.barnybug.github.com" key "b" contains "B"
+    And bucket "s3.barnybug.github.com" key "c" contains "C"
+    And local file "src/a" contains "A"
+    And local file "src/d" contains "D"
+    When I run "s3 sync --delete --max-delete-percent 50 src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And bucket "s3.barnybug.github.com" key "b" exists
+    And bucket "s3.barnybug.github.com" key "d" does not exist
+
+  Scenario: sync reports failed actions and exits with an error
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "a/b" contains "B"
+    And bucket "s3.barnybug.github.com" key "c" contains "C"
+    And local file "dest/a" contains "NOT A DIRECTORY"
+    When I run "s3 sync s3://s3.barnybug.github.com/ dest/"
+    Then the exit code is 1
+    And the output contains "E a/b: "
+    And the output contains "2 added 0 deleted 0 updated 0 unchanged 1 failed\n"
+    And local file "dest/c" has contents "C"
+
+  Scenario: sync --ignore-errors reports failed actions without exiting with an error
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "a/b" contains "B"
+    And local file "dest/a" contains "NOT A DIRECTORY"
+    When I run "s3 --ignore-errors sync s3://s3.barnybug.github.com/ dest/"
+    Then the exit code is 0
+    And the output contains "E a/b: "
+    And the output contains "1 added 0 deleted 0 updated 0 unchanged 1 failed\n"
+
+  Scenario: sync retries failed uploads and deletes
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "b" contains "B"
+    And bucket "s3.barnybug.github.com" key "a" fails 2 times on PutObject
+    And bucket "s3.barnybug.github.com" key "b" fails 2 times on DeleteObject
+    And local file "src/a" contains "A"
+    When I run "s3 --retry-backoff 1ms sync --delete src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "a" with contents "A"
+    And bucket "s3.barnybug.github.com" key "b" does not exist
+    And the output contains "1 added 1 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync limits the request rate with --max-rps
+    Given local file "src/a" contains "A"
+    And local file "src/b" contains "B"
+    And local file "src/c" contains "C"
+    And local file "src/d" contains "D"
+    And local file "src/e" contains "E"
+    And local file "src/f" contains "F"
+    And an S3 compatible server
+    When I run "s3 --max-rps 4 --endpoint SERVER --path-style sync src/ s3://s3.barnybug.github.com/" against the server
+    Then the output contains "6 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+    And the server received "PUT /s3.barnybug.github.com/f"
+    And it was slowed by at least 0.7s
+
+  Scenario: sync --adaptive reduces concurrency when throttled
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And bucket "s3.barnybug.github.com" key "a" fails 2 times on PutObject
+    When I run "s3 --adaptive --retry-backoff 1ms sync src/ s3://s3.barnybug.github.com/"
+    Then bucket "s3.barnybug.github.com" has key "a" with contents "A"
+    And the output contains "concurrency: 4 -> 2 (throttled)\n"
+    And the output contains "1 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+
+  Scenario: sync reports bytes transferred
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "a" contains "AAA"
+    And bucket "s3.barnybug.github.com" key "b" contains "BB"
+    When I run "s3 sync s3://s3.barnybug.github.com/ dest/"
+    Then the output contains "2 added 0 deleted 0 updated 0 unchanged 0 failed\n"
+    And the output contains "transferred: 5 B ("
+
+  Scenario: sync dry-run reports no bytes transferred
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    When I run "s3 sync -n src/ s3://s3.barnybug.github.com/"
+    Then the output does not contain "transferred:"
+
+  Scenario: sync outputs ndjson records
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "b" contains "B"
+    And local file "src/a" contains "AAA"
+    When I run "s3 --output ndjson sync --delete src/ s3://s3.barnybug.github.com/"
+    Then the output contains "{\"action\":\"create\",\"key\":\"a\",\"bytes\":3}\n"
+    And the output contains "{\"action\":\"delete\",\"key\":\"b\",\"bytes\":1}\n"
+    And the output contains "{\"summary\":{\"added\":1,\"deleted\":1,\"updated\":0,\"unchanged\":0,\"failed\":0,\"bytes\":3,\"seconds\":"
+    And the output does not contain "-- summary --"
+
+  Scenario: sync --watch outputs json records as changes are synced
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/b" contains "B"
+    And while watching local file "src/a" changes to "AA"
+    And while watching the output contains "{\n    \"action\": \"create\",\n    \"key\": \"a\",\n    \"bytes\": 2\n  }"
+    When I run "s3 --output json sync --watch --watch-delay 1ms src/ s3://s3.barnybug.github.com/"
+    Then the output contains "[\n  {\n    \"action\": \"create\""
+    And the output contains "}\n]\n"
+
+  Scenario: sync uses defaults from the s3 config file
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And the s3 config file contains "[default]\ndry-run = true\n"
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/"
+    Then the output contains "-- summary (dry-run) --"
+    And bucket "s3.barnybug.github.com" key "a" does not exist
+
+  Scenario: sync uses defaults for the --profile from the s3 config file
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "b" contains "B"
+    And local file "src/a" contains "A"
+    And the s3 config file contains "[default]\nmax-delete = 5\n\n[profile work]\nmax-delete = 0\n"
+    When I run "s3 --profile work sync --delete src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And bucket "s3.barnybug.github.com" key "b" exists
+
+  Scenario: options override the s3 config file
+    Given I have bucket "s3.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "b" contains "B"
+    And local file "src/a" contains "A"
+    And the s3 config file contains "[default]\nmax-delete = 0\n"
+    When I run "s3 sync --delete --max-delete 1 src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 0
+    And bucket "s3.barnybug.github.com" key "b" does not exist
+
+  Scenario: an invalid value in the s3 config file is an error
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "src/a" contains "A"
+    And the s3 config file contains "[default]\nparallel = many\n"
+    When I run "s3 sync src/ s3://s3.barnybug.github.com/"
+    Then the exit code is 1
+    And the output contains "parallel: "
+
+  Scenario: sync to an alias
+    Given I have bucket "s3.barnybug.github.com"
+    And local file "build/a" contains "A"
+    And the s3 config file contains "[alias prod-site]\nbucket = s3.barnybug.github.com\nprefix = www\nprofile = prod\n"
+    When I run "s3 sync build/ s3://prod-site/"
+    Then the exit code is 0
+    And bucket "s3.barnybug.github.com" key "www/a" exists
+
+  Scenario: sync looks up the region of a bucket once
+    Given I have a bucket "s3.barnybug.github.com" in region "eu-west-1"
+    And bucket "s3.barnybug.github.com" key "src/apple" contains "APPLE"
+    When I run "s3 sync s3://s3.barnybug.github.com/src/ s3://s3.barnybug.github.com/dest/"
+    Then bucket "s3.barnybug.github.com" has key "dest/apple" with contents "APPLE"
+    And a connection was made to region "eu-west-1"
+    And the region of a bucket was looked up 1 time
+
+  Scenario: sync looks up the region of a bucket for each account
+    Given I have a bucket "s3.barnybug.github.com" in region "eu-west-1"
+    And bucket "s3.barnybug.github.com" key "src/apple" contains "APPLE"
+    When I run "s3 sync --src-profile a --dest-profile b s3://s3.barnybug.github.com/src/ s3://s3.barnybug.github.com/dest/"
+    Then bucket "s3.barnybug.github.com" has key "dest/apple" with contents "APPLE"
+    And the region of a bucket was looked up 2 times
+
+  Scenario: sync S3 to S3 with the same credentials copies server-side
+    Given I have bucket "s3.barnybug.github.com"
+    And I have bucket "s3b.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "APPLE"
+    And bucket "s3.barnybug.github.com" key "apple" fails 1 time on GetObject
+    When I run "s3 --retries 0 sync --src-profile work --dest-profile work s3://s3.barnybug.github.com/ s3://s3b.barnybug.github.com/"
+    Then the exit code is 0
+    And bucket "s3b.barnybug.github.com" has key "apple" with contents "APPLE"
+
+  Scenario: sync S3 to S3 with different credentials streams the copy
+    Given I have bucket "s3.barnybug.github.com"
+    And I have bucket "s3b.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "APPLE"
+    And bucket "s3.barnybug.github.com" key "apple" fails 1 time on GetObject
+    When I run "s3 --retry-backoff 1ms sync --src-profile a --dest-profile b s3://s3.barnybug.github.com/ s3://s3b.barnybug.github.com/"
+    Then the exit code is 0
+    And bucket "s3b.barnybug.github.com" has key "apple" with contents "APPLE"
+
+  Scenario: sync --backup-prefix copies backups server-side with the destination credentials
+    Given I have bucket "s3.barnybug.github.com"
+    And I have bucket "s3b.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "NEW"
+    And bucket "s3b.barnybug.github.com" key "apple" contains "OLD!"
+    And bucket "s3b.barnybug.github.com" key "apple" fails 1 time on GetObject
+    When I run "s3 --retries 0 sync --src-profile a --dest-profile b --backup-prefix s3://s3b.barnybug.github.com/trash/ s3://s3.barnybug.github.com/ s3://s3b.barnybug.github.com/"
+    Then the exit code is 0
+    And bucket "s3b.barnybug.github.com" has key "trash/apple" with contents "OLD!"
+    And the output contains "U apple\n"
+
+  Scenario: sync S3 to S3 with different credentials keeps headers and metadata
+    Given I have bucket "s3.barnybug.github.com"
+    And I have bucket "s3b.barnybug.github.com"
+    And local file "src/a.txt" contains "A"
+    And local file "src/a.txt" was modified at "2016-01-02T03:04:05Z"
+    And local file "src/a.txt" has permissions "0600"
+    And local file "src/big" contains 6000000 bytes of "x"
+    When I run "s3 sync --part-size 1 src/ s3://s3.barnybug.github.com/"
+    And bucket "s3.barnybug.github.com" key "a.txt" has headers "Cache-Control: max-age=60\nContent-Disposition: inline\nContent-Encoding: identity\nContent-Type: text/x-custom\nExpires: Sat, 02 Jan 2027 03:04:05 GMT\nStorage-Class: STANDARD_IA\nOwner: bob"
+    And I run "s3 sync --src-profile a --dest-profile b s3://s3.barnybug.github.com/ s3://s3b.barnybug.github.com/"
+    Then the exit code is 0
+    And bucket "s3b.barnybug.github.com" has key "a.txt" with contents "A"
+    And bucket "s3b.barnybug.github.com" key "a.txt" has header "Cache-Control" with value "max-age=60"
+    And bucket "s3b.barnybug.github.com" key "a.txt" has header "Content-Disposition" with value "inline"
+    And bucket "s3b.barnybug.github.com" key "a.txt" has header "Content-Encoding" with value "identity"
+    And bucket "s3b.barnybug.github.com" key "a.txt" has header "Content-Type" with value "text/x-custom"
+    And bucket "s3b.barnybug.github.com" key "a.txt" has header "Expires" with value "Sat, 02 Jan 2027 03:04:05 GMT"
+    And bucket "s3b.barnybug.github.com" key "a.txt" has header "Storage-Class" with value "STANDARD_IA"
+    And bucket "s3b.barnybug.github.com" key "a.txt" has metadata "owner" with value "bob"
+    And bucket "s3b.barnybug.github.com" key "a.txt" has metadata "mtime" with value "2016-01-02T03:04:05Z"
+    And bucket "s3b.barnybug.github.com" key "a.txt" has metadata "mode" with value "0600"
+    And bucket "s3b.barnybug.github.com" key "big" has metadata "part-size" with value "5242880"
+    And bucket "s3b.barnybug.github.com" key "big" has metadata "md5" with value "1e17750192abb61e57b2adb7062045ce"
+
+  Scenario: sync S3 to S3 on different endpoints streams the copy
+    Given I have bucket "s3.barnybug.github.com"
+    And I have bucket "s3b.barnybug.github.com"
+    And bucket "s3.barnybug.github.com" key "apple" contains "APPLE"
+    And bucket "s3.barnybug.github.com" key "apple" fails 1 time on GetObject
+    When I run "s3 --retries 0 sync --dest-endpoint http://localhost:9000 s3://s3.barnybug.github.com/ s3://s3b.barnybug.github.com/"
+    Then the exit code is 1
+    And the output contains "1 failed"
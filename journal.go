@@ -0,0 +1,246 @@
+package s3
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// journal records progress of the current sync, if enabled.
+var journal *syncJournal
+
+// syncJournal is an append-only log of completed actions and in-flight
+// multipart uploads, so an interrupted sync can skip work already done and
+// resume uploads from the last completed part.
+type syncJournal struct {
+	sync.Mutex
+	file    *os.File
+	done    map[string]journalRecord
+	uploads map[string]*journalUpload
+}
+
+type journalRecord struct {
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Action      string `json:"action,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Key         string `json:"key,omitempty"`
+	UploadId    string `json:"upload_id,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ModTime     int64  `json:"mtime,omitempty"`
+	PartSize    int64  `json:"part_size,omitempty"`
+	Part        int64  `json:"part,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	Complete    bool   `json:"complete,omitempty"`
+	Aborted     bool   `json:"aborted,omitempty"`
+}
+
+type journalUpload struct {
+	journalRecord
+	parts map[int64]string
+}
+
+// openJournal opens the journal at path for syncing src to dest, replaying
+// any records left by an interrupted run.
+func openJournal(path, src, dest string) (*syncJournal, error) {
+	self := &syncJournal{
+		done:    map[string]journalRecord{},
+		uploads: map[string]*journalUpload{},
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	self.file = file
+
+	header := true
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record journalRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			// a partially written last line
+			continue
+		}
+		if header {
+			if record.Source != src || record.Destination != dest {
+				file.Close()
+				return nil, fmt.Errorf("journal %s is for syncing %s to %s", path, record.Source, record.Destination)
+			}
+			header = false
+			continue
+		}
+		self.replay(record)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if header {
+		err = self.write(journalRecord{Source: src, Destination: dest})
+	}
+	return self, err
+}
+
+func (self *syncJournal) replay(record journalRecord) {
+	switch {
+	case record.Action != "":
+		self.done[record.Path] = record
+	case record.Complete || record.Aborted:
+		delete(self.uploads, record.Key)
+	case record.Part != 0:
+		if upload, ok := self.uploads[record.Key]; ok && upload.UploadId == record.UploadId {
+			upload.parts[record.Part] = record.ETag
+		}
+	case record.UploadId != "":
+		self.uploads[record.Key] = &journalUpload{record, map[int64]string{}}
+	}
+}
+
+func (self *syncJournal) write(record journalRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = self.file.Write(append(data, '\n'))
+	return err
+}
+
+func (self *syncJournal) record(record journalRecord) error {
+	if self == nil {
+		return nil
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.replay(record)
+	return self.write(record)
+}
+
+// Completed returns whether the journal confirms the source file was
+// already synced in its current state.
+func (self *syncJournal) Completed(file File) bool {
+	if self == nil {
+		return false
+	}
+	self.Lock()
+	defer self.Unlock()
+	record, ok := self.done[file.Relative()]
+	return ok && record.Action != "delete" && record.Size == file.Size() && record.ModTime == file.ModTime().UnixNano()
+}
+
+// Done records a completed action.
+func (self *syncJournal) Done(action Action) error {
+	return self.record(journalRecord{
+		Action:  action.Action,
+		Path:    action.File.Relative(),
+		Size:    action.File.Size(),
+		ModTime: action.File.ModTime().UnixNano(),
+	})
+}
+
+// Upload returns the in-flight multipart upload to key, if any, and its
+// completed parts if it can be resumed for src.
+func (self *syncJournal) Upload(key string, src File, partSize int64) (string, map[int64]string, bool) {
+	if self == nil {
+		return "", nil, false
+	}
+	self.Lock()
+	defer self.Unlock()
+	upload, ok := self.uploads[key]
+	if !ok {
+		return "", nil, false
+	}
+	if upload.Size != src.Size() || upload.ModTime != src.ModTime().UnixNano() || upload.PartSize != partSize {
+		// the source has changed
+		return upload.UploadId, nil, false
+	}
+	parts := map[int64]string{}
+	for n, etag := range upload.parts {
+		parts[n] = etag
+	}
+	return upload.UploadId, parts, true
+}
+
+// Uploads returns the in-flight multipart uploads, by key.
+func (self *syncJournal) Uploads() map[string]string {
+	self.Lock()
+	defer self.Unlock()
+	uploads := map[string]string{}
+	for key, upload := range self.uploads {
+		uploads[key] = upload.UploadId
+	}
+	return uploads
+}
+
+func (self *syncJournal) StartUpload(key, uploadId string, src File, partSize int64) error {
+	return self.record(journalRecord{
+		Key:      key,
+		UploadId: uploadId,
+		Size:     src.Size(),
+		ModTime:  src.ModTime().UnixNano(),
+		PartSize: partSize,
+	})
+}
+
+func (self *syncJournal) UploadedPart(key, uploadId string, part int64, etag string) error {
+	return self.record(journalRecord{Key: key, UploadId: uploadId, Part: part, ETag: etag})
+}
+
+func (self *syncJournal) CompletedUpload(key, uploadId string) error {
+	return self.record(journalRecord{Key: key, UploadId: uploadId, Complete: true})
+}
+
+func (self *syncJournal) AbortedUpload(key, uploadId string) error {
+	return self.record(journalRecord{Key: key, UploadId: uploadId, Aborted: true})
+}
+
+// Close closes the journal, removing it if the sync finished so the next
+// run starts afresh.
+func (self *syncJournal) Close(finished bool) error {
+	err := self.file.Close()
+	if err == nil && finished {
+		err = os.Remove(self.file.Name())
+	}
+	return err
+}
+
+// withJournal runs a sync of src to dest with the journal open, if enabled.
+func withJournal(conn s3iface.S3API, src, dest string, fn func() error) error {
+	if journalPath == "" {
+		return fn()
+	}
+	var err error
+	journal, err = openJournal(journalPath, src, dest)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err == nil {
+		// nothing will resume uploads left by failed files once the journal
+		// is removed
+		abortUploads(conn, dest)
+	}
+	if e := journal.Close(err == nil); err == nil {
+		err = e
+	}
+	journal = nil
+	return err
+}
+
+// abortUploads aborts the uploads in-flight in the journal to dest.
+func abortUploads(conn s3iface.S3API, dest string) {
+	if !isS3Url(dest) {
+		return
+	}
+	fs := sideFilesystem(conn, destSettings, dest).(*S3Filesystem)
+	for key, uploadId := range journal.Uploads() {
+		err := fs.abortUpload(strings.TrimPrefix(key, fs.bucket+"/"), uploadId)
+		if err != nil {
+			warn("couldn't abort upload of %s: %s", key, err)
+		}
+	}
+}
@@ -2,24 +2,66 @@ package s3
 
 import (
 	"crypto/md5"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type LocalFilesystem struct {
-	err  error
-	path string
+	err   error
+	path  string
+	cache *checksumCache
 }
 
 func (self *LocalFilesystem) Error() error {
 	return self.err
 }
 
-func scanFiles(ch chan<- File, fullpath string, relpath string) error {
+// resolve applies the --links policy to a directory entry, returning the
+// info to use, the link target if preserving the link, or nil info if the
+// entry should be skipped.
+func (self *LocalFilesystem) resolve(fullpath string, info os.FileInfo) (os.FileInfo, string, error) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch links {
+		case "skip":
+			return nil, "", nil
+		case "preserve":
+			target, err := os.Readlink(fullpath)
+			return info, target, err
+		}
+		target, err := os.Stat(fullpath)
+		if err != nil {
+			warn("skipping broken symlink %s", fullpath)
+			return nil, "", nil
+		}
+		info = target
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		warn("skipping special file %s", fullpath)
+		return nil, "", nil
+	}
+	return info, "", nil
+}
+
+// isLoop returns whether a directory is one of its parents, reached by
+// following a symlink.
+func isLoop(parents []os.FileInfo, info os.FileInfo) bool {
+	for _, parent := range parents {
+		if os.SameFile(parent, info) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *LocalFilesystem) scanFiles(ch chan<- File, fullpath string, relpath string, ignores []*ignoreFile, parents []os.FileInfo) error {
 	entries, err := ioutil.ReadDir(fullpath)
 	if os.IsNotExist(err) {
 		// this is fine - indicates no files are there
@@ -28,35 +70,62 @@ func scanFiles(ch chan<- File, fullpath string, relpath string) error {
 	if err != nil {
 		return err
 	}
+	ignores, err = loadIgnoreFiles(ignores, fullpath)
+	if err != nil {
+		return err
+	}
 	for _, entry := range entries {
 		f := filepath.Join(fullpath, entry.Name())
 		r := filepath.Join(relpath, entry.Name())
-		if entry.IsDir() {
+		info, link, err := self.resolve(f, entry)
+		if err != nil {
+			return err
+		}
+		if info == nil || ignored(ignores, f, info.IsDir()) {
+			continue
+		}
+		if info.IsDir() {
+			if isLoop(parents, info) {
+				warn("skipping symlink loop %s", f)
+				continue
+			}
 			// recurse
-			err := scanFiles(ch, f, r)
+			err := self.scanFiles(ch, f, r, ignores, append(parents[:len(parents):len(parents)], info))
 			if err != nil {
 				return err
 			}
 		} else {
-			ch <- &LocalFile{entry, f, r, nil}
+			ch <- self.file(info, f, r, link)
 		}
 	}
 	return nil
 }
 
-func (self *LocalFilesystem) Files() <-chan File {
-	ch := make(chan File, 1000)
+// file returns a file found walking the filesystem.
+func (self *LocalFilesystem) file(info os.FileInfo, fullpath, relpath, link string) *LocalFile {
+	self.cache.Seen(fullpath, info)
+	return &LocalFile{info: info, fullpath: fullpath, relpath: relpath, cache: self.cache, link: link}
+}
 
-	// use relative path to file or directory:
+// base is the relative path of the root.
+func (self *LocalFilesystem) base() string {
 	// path/to/file -> file
 	// parent/path -> path
 	// path/ -> ''
 	ps := strings.Split(self.path, "/")
-	relpath := ps[len(ps)-1]
+	return ps[len(ps)-1]
+}
+
+func (self *LocalFilesystem) Files() <-chan File {
+	ch := make(chan File, 1000)
+
+	// use relative path to file or directory
+	relpath := self.base()
 	go func() {
 		defer close(ch)
 		fi, err := os.Stat(self.path)
 		if os.IsNotExist(err) {
+			self.cache.Walked(self.path)
 			return
 		}
 		if err != nil {
@@ -64,13 +133,99 @@ func (self *LocalFilesystem) Files() <-chan File {
 			return
 		}
 		if fi.IsDir() {
-			err := scanFiles(ch, self.path, relpath)
+			err := self.scanFiles(ch, self.path, relpath, nil, []os.FileInfo{fi})
 			if err != nil {
 				self.err = err
+				return
 			}
 		} else {
-			ch <- &LocalFile{fi, self.path, relpath, nil}
+			ch <- self.file(fi, self.path, relpath, "")
+		}
+		self.cache.Walked(self.path)
+	}()
+	return ch
+}
+
+// relative returns the relative path, as listed by Files(), of a path
+// beneath the root.
+func (self *LocalFilesystem) relative(fullpath string) (string, error) {
+	r, err := filepath.Rel(self.path, fullpath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(self.base(), r), nil
+}
+
+// fullpath returns the path of a relative path listed by Files(), the
+// inverse of relative.
+func (self *LocalFilesystem) fullpath(relpath string) string {
+	// the relative path starts with the base of the root
+	return filepath.Join(strings.TrimSuffix(self.path, self.base()), relpath)
+}
+
+func (self *LocalFilesystem) FilesUnder(relpath string) <-chan File {
+	ch := make(chan File, 1000)
+	go func() {
+		defer close(ch)
+		r, err := filepath.Rel(self.base(), relpath)
+		if err != nil {
+			self.err = err
+			return
+		}
+		// apply ignore files and links policy from the root down to the path
+		var ignores []*ignoreFile
+		fullpath := self.path
+		root, err := os.Stat(fullpath)
+		if os.IsNotExist(err) {
+			return
+		}
+		if err != nil {
+			self.err = err
+			return
+		}
+		parents := []os.FileInfo{root}
+		for _, name := range strings.Split(r, string(filepath.Separator)) {
+			ignores, err = loadIgnoreFiles(ignores, fullpath)
+			if err != nil {
+				self.err = err
+				return
+			}
+			fullpath = filepath.Join(fullpath, name)
+			fi, err := os.Lstat(fullpath)
+			if os.IsNotExist(err) {
+				self.cache.Walked(fullpath)
+				return
+			}
+			if err != nil {
+				self.err = err
+				return
+			}
+			fi, link, err := self.resolve(fullpath, fi)
+			if err != nil {
+				self.err = err
+				return
+			}
+			if fi == nil || ignored(ignores, fullpath, fi.IsDir()) {
+				self.cache.Walked(fullpath)
+				return
+			}
+			if !fi.IsDir() {
+				ch <- self.file(fi, fullpath, relpath, link)
+				self.cache.Walked(fullpath)
+				return
+			}
+			if isLoop(parents, fi) {
+				warn("skipping symlink loop %s", fullpath)
+				return
+			}
+			parents = append(parents, fi)
 		}
+		err = self.scanFiles(ch, fullpath, relpath, ignores, parents)
+		if err != nil {
+			self.err = err
+			return
+		}
+		self.cache.Walked(fullpath)
 	}()
 	return ch
 }
@@ -82,6 +237,13 @@ func (self *LocalFilesystem) Create(src File) error {
 	}
 	defer reader.Close()
 	fullpath := filepath.Join(self.path, src.Relative())
+	if ok, err := createLink(self.path, fullpath, src); ok || err != nil {
+		return err
+	}
+	err = linksCreated.checkWrite(fullpath)
+	if err != nil {
+		return err
+	}
 	if src.IsDirectory() {
 		err = os.MkdirAll(fullpath, 0777)
 	} else {
@@ -96,11 +258,130 @@ func (self *LocalFilesystem) Create(src File) error {
 			return err
 		}
 		defer writer.Close()
-		_, err = io.Copy(writer, reader)
+		_, err = io.Copy(writer, progress.reader(reader))
+		if err != nil {
+			return err
+		}
+		err = restoreAttributes(fullpath, src)
 	}
 	return err
 }
 
+// restoreAttributes sets the modification time and mode of a file
+// downloaded from S3 to those recorded when it was uploaded, if any.
+func restoreAttributes(fullpath string, src File) error {
+	s, ok := src.(*S3File)
+	if !ok {
+		return nil
+	}
+	v, err := s.meta(metaMode)
+	if err != nil {
+		return err
+	}
+	if mode, err := strconv.ParseUint(v, 8, 32); err == nil {
+		err = os.Chmod(fullpath, os.FileMode(mode).Perm())
+		if err != nil {
+			return err
+		}
+	}
+	v, err = s.meta(metaMtime)
+	if err != nil {
+		return err
+	}
+	if mtime, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return os.Chtimes(fullpath, mtime, mtime)
+	}
+	return nil
+}
+
+// linksCreated records the symlinks created by downloads, which later files
+// must not be written through.
+var linksCreated = &linkSet{}
+
+type linkSet struct {
+	sync.Mutex
+	paths map[string]bool
+}
+
+func (self *linkSet) add(path string) {
+	self.Lock()
+	defer self.Unlock()
+	if self.paths == nil {
+		self.paths = map[string]bool{}
+	}
+	self.paths[path] = true
+}
+
+// checkWrite returns an error if fullpath lies beneath a symlink created by a
+// download.
+func (self *linkSet) checkWrite(fullpath string) error {
+	path, err := filepath.Abs(fullpath)
+	if err != nil {
+		return err
+	}
+	self.Lock()
+	defer self.Unlock()
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if self.paths[dir] {
+			return fmt.Errorf("refusing to write %s through symlink %s", fullpath, dir)
+		}
+	}
+	return nil
+}
+
+// within returns whether path is root or beneath it.
+func within(root, path string) bool {
+	r, err := filepath.Rel(root, path)
+	return err == nil && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator))
+}
+
+// createLink recreates a symlink preserved with --links=preserve, if the
+// download is also preserving links, returning whether src was a link. The
+// target must stay within the destination root.
+func createLink(root, fullpath string, src File) (bool, error) {
+	if links != "preserve" {
+		return false, nil
+	}
+	var target string
+	switch t := src.(type) {
+	case *LocalFile:
+		target = t.link
+	case *S3File:
+		var err error
+		target, err = t.meta(metaSymlink)
+		if err != nil {
+			return false, err
+		}
+	}
+	if target == "" {
+		return false, nil
+	}
+	if filepath.IsAbs(target) || !within(filepath.Clean(root), filepath.Join(filepath.Dir(fullpath), target)) {
+		return true, fmt.Errorf("refusing to create symlink %s to %s outside the destination", fullpath, target)
+	}
+	err := linksCreated.checkWrite(fullpath)
+	if err != nil {
+		return true, err
+	}
+	err = os.MkdirAll(filepath.Dir(fullpath), 0777)
+	if err != nil {
+		return true, err
+	}
+	err = os.Remove(fullpath)
+	if err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	err = os.Symlink(target, fullpath)
+	if err != nil {
+		return true, err
+	}
+	path, err := filepath.Abs(fullpath)
+	if err == nil {
+		linksCreated.add(path)
+	}
+	return true, err
+}
+
 func (self *LocalFilesystem) Delete(path string) error {
 	fullpath := filepath.Join(self.path, path)
 	return os.Remove(fullpath)
@@ -111,6 +392,10 @@ type LocalFile struct {
 	fullpath string
 	relpath  string
 	md5      []byte
+	cache    *checksumCache
+	// link is the target of a symlink preserved as a link, which is
+	// uploaded as its content
+	link string
 }
 
 func (self *LocalFile) Relative() string {
@@ -118,31 +403,79 @@ func (self *LocalFile) Relative() string {
 }
 
 func (self *LocalFile) Size() int64 {
+	if self.link != "" {
+		return int64(len(self.link))
+	}
 	return self.info.Size()
 }
 
+func (self *LocalFile) ModTime() time.Time {
+	return self.info.ModTime()
+}
+
 func (self *LocalFile) IsDirectory() bool {
 	return false
 }
 
-func (self *LocalFile) MD5() []byte {
+func (self *LocalFile) MD5() ([]byte, error) {
+	if self.md5 == nil && self.link != "" {
+		sum := md5.Sum([]byte(self.link))
+		self.md5 = sum[:]
+	}
 	if self.md5 == nil {
-		// cache md5
+		if sum := self.cache.Get(self.fullpath, self.info); sum != nil {
+			self.md5 = sum
+			return self.md5, nil
+		}
 		h := md5.New()
 		reader, err := os.Open(self.fullpath)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
+		defer reader.Close()
 		_, err = io.Copy(h, reader)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
+		// cache md5
 		self.md5 = h.Sum(nil)
+		self.cache.Put(self.fullpath, self.info, self.md5)
 	}
-	return self.md5
+	return self.md5, nil
+}
+
+// multipartETag returns the etag S3 would give the file if uploaded in parts
+// of partSize.
+func (self *LocalFile) multipartETag(partSize int64) (string, error) {
+	reader, err := os.Open(self.fullpath)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	h := md5.New()
+	parts := 0
+	for {
+		part := md5.New()
+		n, err := io.CopyN(part, reader, partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n == 0 && parts > 0 {
+			break
+		}
+		h.Write(part.Sum(nil))
+		parts += 1
+		if n < partSize {
+			break
+		}
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), parts), nil
 }
 
 func (self *LocalFile) Reader() (io.ReadCloser, error) {
+	if self.link != "" {
+		return ioutil.NopCloser(strings.NewReader(self.link)), nil
+	}
 	return os.Open(self.fullpath)
 }
 
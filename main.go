@@ -1,25 +1,52 @@
 package s3
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/urfave/cli"
 )
 
 var (
 	parallel     int
+	adaptive     bool
 	dryRun       bool
 	deleteExtra  bool
 	public       bool
 	quiet        bool
 	ignoreErrors bool
 	acl          string
+	partSizeMB   int
+
+	retries      int
+	retryBackoff time.Duration
+	retryJitter  float64
+
+	checksumCachePath string
+	useGitignore      bool
+	links             string
+
+	journalPath string
+	planOut     string
+
+	backupPrefix string
+
+	maxDelete        int
+	maxDeletePercent float64
+	force            bool
+
+	watch         bool
+	watchDelay    time.Duration
+	watchInterval time.Duration
+
+	sizeOnly        bool
+	compareChecksum bool
+	compareMtime    bool
+	newerOnly       bool
 )
 var version = "master" /* passed in by go build */
 
@@ -41,24 +68,51 @@ func validACL() bool {
 	return true
 }
 
+func validLinks() bool {
+	switch links {
+	case "follow", "skip", "preserve":
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "links should be one of: follow, skip, preserve")
+	return false
+}
+
 func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 	out = output
 	exitCode := 0
+	filters = nil
+	backups = nil
+	links = ""
+	linksCreated = &linkSet{}
+	maxDelete, maxDeletePercent = -1, 100
+	uploadLimit, downloadLimit = &rateLimiter{}, &rateLimiter{}
+	outputFormat, records = "text", 0
+	caCerts = nil
+	srcSettings, destSettings = connSettings{}, connSettings{}
+	requestLimit = &rateLimiter{}
 
 	checkErr := func(err error) {
 		if err != nil {
-			fmt.Fprintf(out, "Error: %s\n", err)
+			printError(err)
 			exitCode = 1
 		}
 	}
 
+	injected := conn
+	connections = map[connSettings]s3iface.S3API{}
+	bucketRegions = map[bucketKey]string{}
+	connect = func(settings connSettings) s3iface.S3API {
+		if c, ok := injected.(connector); ok {
+			return c.connect(settings)
+		}
+		if injected != nil {
+			return injected
+		}
+		return cachedConnection(settings)
+	}
 	getConnection := func(c *cli.Context) s3iface.S3API {
 		if conn == nil {
-			region := c.Parent().String("region")
-			config := aws.Config{
-				Region: aws.String(region),
-			}
-			conn = s3.New(session.New(), &config)
+			conn = connect(connSettings{})
 		}
 		return conn
 	}
@@ -70,6 +124,11 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 			Usage:       "number of parallel operations to run",
 			Destination: &parallel,
 		},
+		cli.BoolFlag{
+			Name:        "adaptive",
+			Usage:       "adjust the number of parallel operations to throughput and throttling, up to -p",
+			Destination: &adaptive,
+		},
 		cli.BoolFlag{
 			Name:        "n",
 			Usage:       "dry-run, no actions taken",
@@ -77,7 +136,7 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 		},
 		cli.BoolFlag{
 			Name:        "ignore-errors",
-			Usage:       "",
+			Usage:       "report failed actions without exiting with an error",
 			Destination: &ignoreErrors,
 		},
 		cli.BoolFlag{
@@ -85,11 +144,95 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 			Usage:       "",
 			Destination: &quiet,
 		},
+	}
+
+	// globalFlags are only registered on the app, as registering a flag
+	// again on a command resets its destination
+	globalFlags := []cli.Flag{
+		cli.Float64Flag{
+			Name:        "max-rps",
+			Usage:       "limit the rate of S3 requests per second",
+			Destination: &requestLimit.rate,
+		},
+		cli.IntFlag{
+			Name:        "retries",
+			Value:       5,
+			Usage:       "number of times to retry transient errors",
+			Destination: &retries,
+		},
+		cli.DurationFlag{
+			Name:        "retry-backoff",
+			Value:       100 * time.Millisecond,
+			Usage:       "wait before the first retry, doubling for each subsequent retry",
+			Destination: &retryBackoff,
+		},
+		cli.Float64Flag{
+			Name:        "retry-jitter",
+			Value:       0.5,
+			Usage:       "randomly reduce each wait by up to this fraction",
+			Destination: &retryJitter,
+		},
+		cli.GenericFlag{
+			Name:  "bwlimit",
+			Usage: "limit upload and download bandwidth, in bytes per second with an optional K, M or G suffix",
+			Value: &rateFlag{limiters: []*rateLimiter{uploadLimit, downloadLimit}},
+		},
+		cli.GenericFlag{
+			Name:  "bwlimit-up",
+			Usage: "limit upload bandwidth, overriding --bwlimit",
+			Value: &rateFlag{limiters: []*rateLimiter{uploadLimit}, specific: true},
+		},
+		cli.GenericFlag{
+			Name:  "bwlimit-down",
+			Usage: "limit download bandwidth, overriding --bwlimit",
+			Value: &rateFlag{limiters: []*rateLimiter{downloadLimit}, specific: true},
+		},
+		cli.GenericFlag{
+			Name:  "output",
+			Usage: "output format: text (default), or json or ndjson records, implying -q",
+			Value: &outputFlag{},
+		},
+		cli.StringFlag{
+			Name:        "profile",
+			Usage:       "use the named profile of ~/.aws/config, ~/.aws/credentials and the s3 config file",
+			EnvVar:      "AWS_PROFILE,AWS_DEFAULT_PROFILE",
+			Destination: &profile,
+		},
 		cli.StringFlag{
-			Name:   "region",
-			Usage:  "set region, otherwise environment variable AWS_REGION is checked, finally defaulting to us-east-1",
-			Value:  "us-east-1",
-			EnvVar: "AWS_REGION",
+			Name:        "region",
+			Usage:       "set region, otherwise environment variable AWS_REGION or the profile's region is used, finally defaulting to us-east-1",
+			EnvVar:      "AWS_REGION",
+			Destination: &region,
+		},
+		cli.StringFlag{
+			Name:        "endpoint",
+			Usage:       "url of an S3 compatible server, such as http://localhost:9000",
+			EnvVar:      "S3_ENDPOINT,AWS_ENDPOINT_URL_S3,AWS_ENDPOINT_URL",
+			Destination: &endpoint,
+		},
+		cli.BoolFlag{
+			Name:        "path-style",
+			Usage:       "address buckets in the path rather than the hostname, as many S3 compatible servers need",
+			EnvVar:      "S3_PATH_STYLE",
+			Destination: &pathStyle,
+		},
+		cli.BoolFlag{
+			Name:        "no-verify-ssl",
+			Usage:       "don't verify the server's certificate",
+			EnvVar:      "S3_NO_VERIFY_SSL",
+			Destination: &noVerifySSL,
+		},
+		cli.BoolFlag{
+			Name:        "no-sign-request",
+			Usage:       "don't sign requests or look for credentials, to access public buckets",
+			EnvVar:      "S3_NO_SIGN_REQUEST",
+			Destination: &noSignRequest,
+		},
+		cli.GenericFlag{
+			Name:   "ca-bundle",
+			Usage:  "trust the certificates in this PEM file",
+			EnvVar: "AWS_CA_BUNDLE",
+			Value:  &caBundleFlag{},
 		},
 	}
 
@@ -108,19 +251,176 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 		Usage:       "delete extraneous files from destination",
 		Destination: &deleteExtra,
 	}
+	partSizeFlag := cli.IntFlag{
+		Name:        "part-size",
+		Value:       5,
+		Usage:       "multipart upload part size in MiB, also used to compare multipart etags",
+		Destination: &partSizeMB,
+	}
+	checksumCacheFlag := cli.StringFlag{
+		Name:        "checksum-cache",
+		Usage:       "file to cache md5s of local files between runs",
+		EnvVar:      "S3_CHECKSUM_CACHE",
+		Destination: &checksumCachePath,
+	}
+	gitignoreFlag := cli.BoolFlag{
+		Name:        "gitignore",
+		Usage:       "honour .gitignore files and skip .git directories, as well as .s3ignore files",
+		Destination: &useGitignore,
+	}
+	linksFlag := cli.StringFlag{
+		Name:        "links",
+		Value:       "follow",
+		Usage:       "symlinks to follow, skip, or preserve as links, storing the target in metadata",
+		Destination: &links,
+	}
+	watchFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:        "watch",
+			Usage:       "keep syncing a local source as files change",
+			Destination: &watch,
+		},
+		cli.DurationFlag{
+			Name:        "watch-delay",
+			Value:       time.Second,
+			Usage:       "wait for changes to settle for this long before syncing",
+			Destination: &watchDelay,
+		},
+		cli.DurationFlag{
+			Name:        "watch-interval",
+			Value:       10 * time.Minute,
+			Usage:       "rerun a full sync this often to catch missed changes",
+			Destination: &watchInterval,
+		},
+	}
+	journalFlag := cli.StringFlag{
+		Name:        "journal",
+		Usage:       "record progress in file so an interrupted sync can be resumed",
+		Destination: &journalPath,
+	}
+	maxDeleteFlag := cli.IntFlag{
+		Name:        "max-delete",
+		Value:       -1,
+		Usage:       "abort without deleting anything if more than this many files would be deleted",
+		Destination: &maxDelete,
+	}
+	maxDeletePercentFlag := cli.Float64Flag{
+		Name:        "max-delete-percent",
+		Value:       100,
+		Usage:       "abort without deleting anything if more than this percentage of destination files would be deleted",
+		Destination: &maxDeletePercent,
+	}
+	backupFlag := cli.StringFlag{
+		Name:        "backup-prefix",
+		Usage:       "copy files to this s3 url or local directory before they are overwritten or deleted",
+		Destination: &backupPrefix,
+	}
+	sideFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "src-profile",
+			Usage:       "use the named profile for the source, rather than --profile",
+			Destination: &srcSettings.profile,
+		},
+		cli.StringFlag{
+			Name:        "dest-profile",
+			Usage:       "use the named profile for the destination, rather than --profile",
+			Destination: &destSettings.profile,
+		},
+		cli.StringFlag{
+			Name:        "src-endpoint",
+			Usage:       "url of an S3 compatible server for the source, rather than --endpoint",
+			Destination: &srcSettings.endpoint,
+		},
+		cli.StringFlag{
+			Name:        "dest-endpoint",
+			Usage:       "url of an S3 compatible server for the destination, rather than --endpoint",
+			Destination: &destSettings.endpoint,
+		},
+	}
+	planOutFlag := cli.StringFlag{
+		Name:        "plan-out",
+		Usage:       "write the actions to file as json for s3 apply, instead of performing them",
+		Destination: &planOut,
+	}
+	compareFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:        "size-only",
+			Usage:       "compare files by size only",
+			Destination: &sizeOnly,
+		},
+		cli.BoolFlag{
+			Name:        "checksum",
+			Usage:       "compare files by size and md5 (default)",
+			Destination: &compareChecksum,
+		},
+		cli.BoolFlag{
+			Name:        "mtime",
+			Usage:       "compare files by size and modification time",
+			Destination: &compareMtime,
+		},
+		cli.BoolFlag{
+			Name:        "newer",
+			Usage:       "never overwrite destination files newer than the source",
+			Destination: &newerOnly,
+		},
+	}
+
+	filterFlags := []cli.Flag{
+		cli.GenericFlag{
+			Name:  "include",
+			Usage: "include keys matching pattern, taking precedence over later --exclude",
+			Value: &filterFlag{include: true},
+		},
+		cli.GenericFlag{
+			Name:  "exclude",
+			Usage: "exclude keys matching pattern, taking precedence over later --include",
+			Value: &filterFlag{},
+		},
+		cli.GenericFlag{
+			Name:  "exclude-from",
+			Usage: "read exclude patterns from file",
+			Value: &filterFlag{fromFile: true},
+		},
+	}
 
 	app := cli.NewApp()
 	app.Name = "s3"
 	app.Usage = "S3 utility knife"
 	app.Version = version
-	app.Flags = commonFlags
+	app.Flags = append(commonFlags, globalFlags...)
 	app.Writer = out
 	app.Commands = []cli.Command{
+		{
+			Name:      "apply",
+			Usage:     "Perform the actions of a plan written by sync --plan-out",
+			ArgsUsage: "plan.json",
+			Flags:     append([]cli.Flag{aclFlag, publicFlag, partSizeFlag, checksumCacheFlag, backupFlag}, sideFlags...),
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 1 {
+					cli.ShowCommandHelp(c, "apply")
+					exitCode = 1
+					return
+				}
+				if public {
+					acl = "public-read"
+				}
+				if !validACL() {
+					exitCode = 1
+					return
+				}
+				conn := getConnection(c)
+				backups = backupFilesystem(conn)
+				err := withChecksumCache(func() error {
+					return applyPlan(conn, c.Args().First())
+				})
+				checkErr(err)
+			},
+		},
 		{
 			Name:      "cat",
 			Usage:     "Cat key contents",
 			ArgsUsage: "key ...",
-			Flags:     commonFlags,
+			Flags:     append(commonFlags, filterFlags...),
 			Action: func(c *cli.Context) {
 				if len(c.Args()) == 0 {
 					cli.ShowCommandHelp(c, "cat")
@@ -136,6 +436,7 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 			Name:      "get",
 			Usage:     "Download keys",
 			ArgsUsage: "key ...",
+			Flags:     append([]cli.Flag{linksFlag}, filterFlags...),
 			Action: func(c *cli.Context) {
 				if len(c.Args()) == 0 {
 					cli.ShowCommandHelp(c, "get")
@@ -151,7 +452,7 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 			Name:      "grep",
 			Usage:     "Grep keys",
 			ArgsUsage: "string key ...",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.BoolFlag{
 					Name:  "no-keys-prefix",
 					Usage: "Suppress the prefixing of key names on output",
@@ -160,7 +461,7 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 					Name:  "keys-with-matches, l",
 					Usage: "only print the name of each key which contains matches",
 				},
-			},
+			}, filterFlags...),
 			Action: func(c *cli.Context) {
 				if len(c.Args()) < 2 {
 					cli.ShowCommandHelp(c, "grep")
@@ -178,6 +479,7 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 			Name:      "ls",
 			Usage:     "List buckets or keys",
 			ArgsUsage: "[bucket]",
+			Flags:     filterFlags,
 			Action: func(c *cli.Context) {
 				var err error
 				if len(c.Args()) < 1 {
@@ -209,7 +511,7 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 			Name:      "put",
 			Usage:     "Upload files",
 			ArgsUsage: "source [source ...] dest",
-			Flags:     []cli.Flag{aclFlag, publicFlag},
+			Flags:     append([]cli.Flag{aclFlag, publicFlag, partSizeFlag, checksumCacheFlag, gitignoreFlag, linksFlag}, filterFlags...),
 			Action: func(c *cli.Context) {
 				if len(c.Args()) < 2 {
 					cli.ShowCommandHelp(c, "put")
@@ -219,7 +521,7 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 				if public {
 					acl = "public-read"
 				}
-				if !validACL() {
+				if !validACL() || !validLinks() {
 					exitCode = 1
 					return
 				}
@@ -227,7 +529,9 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 				args := c.Args()
 				sources := args[:len(args)-1]
 				destination := args[len(args)-1]
-				err := putKeys(conn, sources, destination)
+				err := withChecksumCache(func() error {
+					return putKeys(conn, sources, destination)
+				})
 				checkErr(err)
 			},
 		},
@@ -250,6 +554,15 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 			Name:      "rm",
 			Usage:     "Remove keys",
 			ArgsUsage: "key ...",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:        "force",
+					Usage:       "allow removing everything in a bucket",
+					Destination: &force,
+				},
+				maxDeleteFlag,
+				maxDeletePercentFlag,
+			}, filterFlags...),
 			Action: func(c *cli.Context) {
 				if len(c.Args()) == 0 {
 					cli.ShowCommandHelp(c, "rm")
@@ -265,7 +578,7 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 			Name:      "sync",
 			Usage:     "Synchronise local to s3, s3 to s3 or s3 to local",
 			ArgsUsage: "source dest",
-			Flags:     []cli.Flag{aclFlag, publicFlag, deleteFlag},
+			Flags:     append(append(append(append([]cli.Flag{aclFlag, publicFlag, deleteFlag, partSizeFlag, checksumCacheFlag, gitignoreFlag, linksFlag, journalFlag, planOutFlag, backupFlag, maxDeleteFlag, maxDeletePercentFlag}, compareFlags...), filterFlags...), watchFlags...), sideFlags...),
 			Action: func(c *cli.Context) {
 				if len(c.Args()) != 2 {
 					cli.ShowCommandHelp(c, "sync")
@@ -275,16 +588,58 @@ func Main(conn s3iface.S3API, args []string, output io.Writer) int {
 				if public {
 					acl = "public-read"
 				}
-				if !validACL() {
+				if !validACL() || !validLinks() {
 					exitCode = 1
 					return
 				}
 				conn := getConnection(c)
-				err := syncFiles(conn, c.Args()[0], c.Args()[1])
+				backups = backupFilesystem(conn)
+				err := withChecksumCache(func() error {
+					src, dest := c.Args()[0], c.Args()[1]
+					if watch {
+						if planOut != "" {
+							return errors.New("--plan-out can't be used with --watch")
+						}
+						return watchSync(conn, src, dest)
+					}
+					return withPlan(conn, src, dest, func() error {
+						return withJournal(conn, src, dest, func() error {
+							return syncFiles(conn, src, dest)
+						})
+					})
+				})
 				checkErr(err)
 			},
 		},
 	}
-	app.Run(args)
+
+	// apply defaults and aliases from the s3 config file
+	app.Before = func(c *cli.Context) error {
+		err := applyConfig(c, app.Flags)
+		if err == nil {
+			err = loadAliases()
+		}
+		if err != nil {
+			printError(err)
+		}
+		return err
+	}
+	for i := range app.Commands {
+		command := &app.Commands[i]
+		command.Before = func(c *cli.Context) error {
+			err := applyConfig(c, command.Flags)
+			if err != nil {
+				printError(err)
+			}
+			return err
+		}
+	}
+
+	err := app.Run(args)
+	if err != nil {
+		// incorrect usage or config, already reported
+		exitCode = 1
+	}
+	flushRecords()
 	return exitCode
 }
@@ -2,13 +2,22 @@ package s3
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/client/metadata"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -19,20 +28,251 @@ var (
 	ErrNoSuchBucket  = errors.New("NoSuchBucket: The specified bucket does not exist")
 	ErrBucketExists  = errors.New("Bucket already exists")
 	ErrBucketHasKeys = errors.New("Bucket has keys so cannot be deleted")
+	ErrNoSuchUpload  = awserr.NewRequestFailure(awserr.New("NoSuchUpload", "The specified upload does not exist", nil), 404, "")
+	ErrObjectMissing = awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "")
+	ErrSlowDown      = awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "")
+	ErrPrecondition  = awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), 412, "")
+	ErrAccessDenied  = awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
 )
 
-type MockBucket map[string][]byte
+type MockObject struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+	metadata     map[string]*string
+	headers      objectHeaders
+}
+
+func newMockObject(data []byte, metadata map[string]*string) *MockObject {
+	sum := md5.Sum(data)
+	return &MockObject{
+		data:         data,
+		etag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		lastModified: time.Now(),
+		metadata:     canonicalMetadata(metadata),
+	}
+}
+
+// canonicalMetadata mimics S3 returning user metadata with canonical
+// header casing.
+func canonicalMetadata(metadata map[string]*string) map[string]*string {
+	ret := map[string]*string{}
+	for k, v := range metadata {
+		ret[http.CanonicalHeaderKey(k)] = v
+	}
+	return ret
+}
+
+// mockExpires formats an Expires header as S3 returns it.
+func mockExpires(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	return aws.String(t.UTC().Format(http.TimeFormat))
+}
+
+type mockUpload struct {
+	bucket   string
+	key      string
+	metadata map[string]*string
+	headers  objectHeaders
+	parts    map[int64][]byte
+}
+
+type MockBucket map[string]*MockObject
 
 type MockS3 struct {
 	sync.RWMutex
-	// bucket: {key: value}
+	// bucket: {key: object}
 	data map[string]MockBucket
+	// bucket: region, if not us-east-1
+	regions map[string]string
+	// regions of the connections made
+	connections []string
+	// upload id: in-progress multipart upload
+	uploads  map[string]*mockUpload
+	uploadId int
+	// "operation bucket/key": remaining faults to inject
+	faults     map[string]int
+	faultsLock sync.Mutex
+	// operation: number of requests, for those counted
+	requests     map[string]int
+	requestsLock sync.Mutex
 }
 
 func NewMockS3() *MockS3 {
 	return &MockS3{
-		data: map[string]MockBucket{},
+		data:     map[string]MockBucket{},
+		regions:  map[string]string{},
+		uploads:  map[string]*mockUpload{},
+		faults:   map[string]int{},
+		requests: map[string]int{},
+	}
+}
+
+// FailNext makes the next n requests of operation (GetObject, PutObject,
+// DeleteObject or UploadPartCopy) on key fail with a 503 SlowDown error.
+// The GetObject operation "Truncate" instead cuts the body short, and
+// "Slow" returns it slowly. HeadObject fails as if the key was deleted.
+func (self *MockS3) FailNext(operation, bucket, key string, n int) {
+	self.faultsLock.Lock()
+	defer self.faultsLock.Unlock()
+	self.faults[operation+" "+bucket+"/"+key] = n
+}
+
+// fault returns whether to inject a fault in this request.
+func (self *MockS3) fault(operation, bucket, key string) bool {
+	self.faultsLock.Lock()
+	defer self.faultsLock.Unlock()
+	name := operation + " " + bucket + "/" + key
+	if self.faults[name] > 0 {
+		self.faults[name] -= 1
+		return true
+	}
+	return false
+}
+
+// connect records a connection made by Main with settings, standing in for
+// it.
+func (self *MockS3) connect(settings connSettings) s3iface.S3API {
+	self.Lock()
+	defer self.Unlock()
+	self.connections = append(self.connections, settings.region)
+	return self
+}
+
+// Connections returns the regions of the connections made, "" for the
+// default.
+func (self *MockS3) Connections() []string {
+	self.RLock()
+	defer self.RUnlock()
+	return append([]string{}, self.connections...)
+}
+
+// count counts a request of operation.
+func (self *MockS3) count(operation string) {
+	self.requestsLock.Lock()
+	defer self.requestsLock.Unlock()
+	self.requests[operation] += 1
+}
+
+// Requests returns the number of requests made of the operations, counted
+// for GetBucketLocation, GetObject, HeadBucket, HeadObject and
+// UploadPartCopy.
+func (self *MockS3) Requests(operations ...string) int {
+	self.requestsLock.Lock()
+	defer self.requestsLock.Unlock()
+	n := 0
+	for _, operation := range operations {
+		n += self.requests[operation]
+	}
+	return n
+}
+
+// MockClock is a clock for rate limiters where sleeping advances the time
+// instead of waiting, for tests of limits that don't take as long.
+type MockClock struct {
+	sync.Mutex
+	start, now time.Time
+}
+
+// MockStderr sets where errors and progress are written, or restores
+// stderr if w is nil.
+func MockStderr(w io.Writer) {
+	if w == nil {
+		w = os.Stderr
+	}
+	err = w
+}
+
+// MockProgressInterval sets how often progress is logged when not on a
+// terminal, or restores the default if interval is 0.
+func MockProgressInterval(interval time.Duration) {
+	if interval == 0 {
+		interval = defaultProgressInterval
 	}
+	progressInterval = interval
+}
+
+// MockMaxCopySize sets the largest object copied in a single request, so
+// copies in parts can be tested, or restores the default if size is 0.
+func MockMaxCopySize(size int64) {
+	if size == 0 {
+		size = defaultMaxCopySize
+	}
+	maxCopySize = size
+}
+
+// UseMockClock makes rate limiters use a new MockClock.
+func UseMockClock() *MockClock {
+	now := time.Now()
+	self := &MockClock{start: now, now: now}
+	clock = self
+	return self
+}
+
+func (self *MockClock) Now() time.Time {
+	self.Lock()
+	defer self.Unlock()
+	return self.now
+}
+
+// Sleep advances the time by d without waiting.
+func (self *MockClock) Sleep(d time.Duration) {
+	self.Lock()
+	defer self.Unlock()
+	self.now = self.now.Add(d)
+}
+
+// Elapsed returns how far the time has advanced.
+func (self *MockClock) Elapsed() time.Duration {
+	self.Lock()
+	defer self.Unlock()
+	return self.now.Sub(self.start)
+}
+
+// MockWatch makes sync --watch call feed with the source directory and a
+// channel to send changed paths on, instead of watching for changes, until
+// feed returns. A nil feed watches for changes again.
+func MockWatch(feed func(root string, events chan<- string)) {
+	if feed == nil {
+		watchFiles = notifyChanges
+		return
+	}
+	watchFiles = func(root string) (<-chan string, error) {
+		ch := make(chan string)
+		go func() {
+			defer close(ch)
+			feed(root, ch)
+		}()
+		return ch, nil
+	}
+}
+
+// slowReader returns its data a byte at a time, slowly.
+type slowReader struct {
+	io.Reader
+}
+
+func (self slowReader) Read(p []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return self.Reader.Read(p)
+}
+
+// truncatedReader returns its data followed by an unexpected EOF.
+type truncatedReader struct {
+	io.Reader
+}
+
+func (self truncatedReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
 }
 
 func (self *MockS3) ListBuckets(*s3.ListBucketsInput) (*s3.ListBucketsOutput, error) {
@@ -57,6 +297,7 @@ func (self *MockS3) DeleteBucket(input *s3.DeleteBucketInput) (*s3.DeleteBucketO
 			return nil, ErrBucketHasKeys
 		}
 		delete(self.data, *input.Bucket)
+		delete(self.regions, *input.Bucket)
 		return &s3.DeleteBucketOutput{}, nil
 	} else {
 		return nil, ErrNoSuchBucket
@@ -70,9 +311,58 @@ func (self *MockS3) CreateBucket(input *s3.CreateBucketInput) (*s3.CreateBucketO
 		return nil, ErrBucketExists
 	}
 	self.data[*input.Bucket] = MockBucket{}
+	if input.CreateBucketConfiguration != nil {
+		self.regions[*input.Bucket] = aws.StringValue(input.CreateBucketConfiguration.LocationConstraint)
+	}
 	return &s3.CreateBucketOutput{}, nil
 }
 
+// GetBucketLocation returns the region of the bucket, or fails with
+// AccessDenied as for a bucket of another account when failing
+// GetBucketLocation on the bucket with an empty key.
+func (self *MockS3) GetBucketLocation(input *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
+	self.RLock()
+	defer self.RUnlock()
+	self.count("GetBucketLocation")
+	if self.fault("GetBucketLocation", *input.Bucket, "") {
+		return nil, ErrAccessDenied
+	}
+	if _, exists := self.data[*input.Bucket]; !exists {
+		return nil, ErrNoSuchBucket
+	}
+	output := s3.GetBucketLocationOutput{}
+	if region := self.regions[*input.Bucket]; region != "" {
+		output.LocationConstraint = aws.String(region)
+	}
+	return &output, nil
+}
+
+// HeadBucketRequest returns a request responding with the region of the
+// bucket in the X-Amz-Bucket-Region header.
+func (self *MockS3) HeadBucketRequest(input *s3.HeadBucketInput) (*request.Request, *s3.HeadBucketOutput) {
+	self.RLock()
+	defer self.RUnlock()
+	self.count("HeadBucket")
+	req := mockRequest(nil)
+	if _, exists := self.data[*input.Bucket]; !exists {
+		req.Build()
+		req.Error = ErrNoSuchBucket
+		return req, &s3.HeadBucketOutput{}
+	}
+	region := self.regions[*input.Bucket]
+	if region == "" {
+		region = "us-east-1"
+	}
+	req.Handlers.Send.PushBack(func(r *request.Request) {
+		r.HTTPResponse = &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"X-Amz-Bucket-Region": []string{region}},
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+	})
+	return req, &s3.HeadBucketOutput{}
+}
+
 func (self *MockS3) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
 	self.RLock()
 	defer self.RUnlock()
@@ -91,8 +381,11 @@ func (self *MockS3) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutp
 	for _, key := range keys {
 		value := bucket[key]
 		object := s3.Object{
-			Key:  aws.String(key),
-			Size: aws.Int64(int64(len(value))),
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(value.data))),
+			ETag:         aws.String(value.etag),
+			LastModified: aws.Time(value.lastModified),
+			StorageClass: value.headers.StorageClass,
 		}
 		contents = append(contents, &object)
 	}
@@ -105,13 +398,45 @@ func (self *MockS3) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutp
 }
 
 func (self *MockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	self.count("GetObject")
 	self.RLock()
 	defer self.RUnlock()
+	if self.fault("GetObject", *input.Bucket, *input.Key) {
+		return nil, ErrSlowDown
+	}
 	bucket := self.data[*input.Bucket]
 	if object, ok := bucket[*input.Key]; ok {
-		body := ioutil.NopCloser(bytes.NewReader(object))
+		if input.IfMatch != nil && *input.IfMatch != object.etag {
+			return nil, ErrPrecondition
+		}
+		data := object.data
+		if input.Range != nil {
+			var start int
+			_, err := fmt.Sscanf(*input.Range, "bytes=%d-", &start)
+			if err != nil || start >= len(data) {
+				return nil, fmt.Errorf("InvalidRange: %s", *input.Range)
+			}
+			data = data[start:]
+		}
+		var body io.Reader = bytes.NewReader(data)
+		if self.fault("Truncate", *input.Bucket, *input.Key) {
+			body = truncatedReader{bytes.NewReader(data[:len(data)/2])}
+		} else if self.fault("Slow", *input.Bucket, *input.Key) {
+			body = slowReader{body}
+		}
 		output := s3.GetObjectOutput{
-			Body: body,
+			Body:               ioutil.NopCloser(body),
+			CacheControl:       object.headers.CacheControl,
+			ContentDisposition: object.headers.ContentDisposition,
+			ContentEncoding:    object.headers.ContentEncoding,
+			ContentLanguage:    object.headers.ContentLanguage,
+			ContentLength:      aws.Int64(int64(len(data))),
+			ContentType:        object.headers.ContentType,
+			ETag:               aws.String(object.etag),
+			Expires:            object.headers.Expires,
+			LastModified:       aws.Time(object.lastModified),
+			Metadata:           object.metadata,
+			StorageClass:       object.headers.StorageClass,
 		}
 		return &output, nil
 	} else {
@@ -119,12 +444,27 @@ func (self *MockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, er
 	}
 }
 
+// newMockPut returns the object stored by a put.
+func newMockPut(content []byte, input *s3.PutObjectInput) *MockObject {
+	object := newMockObject(content, input.Metadata)
+	object.headers = objectHeaders{
+		CacheControl:       input.CacheControl,
+		ContentDisposition: input.ContentDisposition,
+		ContentEncoding:    input.ContentEncoding,
+		ContentLanguage:    input.ContentLanguage,
+		ContentType:        input.ContentType,
+		Expires:            mockExpires(input.Expires),
+		StorageClass:       input.StorageClass,
+	}
+	return object
+}
+
 func (self *MockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
 	self.Lock()
 	defer self.Unlock()
 	content, _ := ioutil.ReadAll(input.Body)
 	if bucket, ok := self.data[*input.Bucket]; ok {
-		bucket[*input.Key] = content
+		bucket[*input.Key] = newMockPut(content, input)
 	} else {
 		return nil, ErrNoSuchBucket
 	}
@@ -134,12 +474,15 @@ func (self *MockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, er
 func (self *MockS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
 	self.Lock()
 	defer self.Unlock()
+	if self.fault("PutObject", *input.Bucket, *input.Key) {
+		return mockRequest(ErrSlowDown), &s3.PutObjectOutput{}
+	}
 	// required for s3manager.Upload
 	// TODO: should only alter bucket on Send()
 	content, _ := ioutil.ReadAll(input.Body)
 	req := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{}, nil, nil)
 	if bucket, ok := self.data[*input.Bucket]; ok {
-		bucket[*input.Key] = content
+		bucket[*input.Key] = newMockPut(content, input)
 	} else {
 		// pre-set the error on the request
 		req.Build()
@@ -152,49 +495,272 @@ func (self *MockS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjec
 	self.Lock()
 	defer self.Unlock()
 	bucket := self.data[*input.Bucket]
+	output := s3.DeleteObjectsOutput{}
 	for _, id := range input.Delete.Objects {
+		if self.fault("DeleteObject", *input.Bucket, *id.Key) {
+			output.Errors = append(output.Errors, &s3.Error{
+				Code:    aws.String("SlowDown"),
+				Key:     id.Key,
+				Message: aws.String("Please reduce your request rate."),
+			})
+			continue
+		}
 		delete(bucket, *id.Key)
 	}
-	return &s3.DeleteObjectsOutput{}, nil
+	return &output, nil
 }
 
 func (self *MockS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
 	self.Lock()
 	defer self.Unlock()
+	if self.fault("DeleteObject", *input.Bucket, *input.Key) {
+		return nil, ErrSlowDown
+	}
 	bucket := self.data[*input.Bucket]
 	delete(bucket, *input.Key)
 	return &s3.DeleteObjectOutput{}, nil
 }
 
-// unimplemented
+func (self *MockS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	self.RLock()
+	defer self.RUnlock()
+	self.count("HeadObject")
+	if self.fault("HeadObject", *input.Bucket, *input.Key) {
+		return nil, ErrObjectMissing
+	}
+	bucket := self.data[*input.Bucket]
+	if object, ok := bucket[*input.Key]; ok {
+		output := s3.HeadObjectOutput{
+			CacheControl:       object.headers.CacheControl,
+			ContentDisposition: object.headers.ContentDisposition,
+			ContentEncoding:    object.headers.ContentEncoding,
+			ContentLanguage:    object.headers.ContentLanguage,
+			ContentLength:      aws.Int64(int64(len(object.data))),
+			ContentType:        object.headers.ContentType,
+			ETag:               aws.String(object.etag),
+			Expires:            object.headers.Expires,
+			LastModified:       aws.Time(object.lastModified),
+			Metadata:           object.metadata,
+			StorageClass:       object.headers.StorageClass,
+		}
+		return &output, nil
+	} else {
+		return nil, ErrObjectMissing
+	}
+}
+
+func (self *MockS3) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.data[*input.Bucket]; !ok {
+		return nil, ErrNoSuchBucket
+	}
+	self.uploadId += 1
+	id := fmt.Sprintf("upload%d", self.uploadId)
+	self.uploads[id] = &mockUpload{
+		bucket:   *input.Bucket,
+		key:      *input.Key,
+		metadata: input.Metadata,
+		headers: objectHeaders{
+			CacheControl:       input.CacheControl,
+			ContentDisposition: input.ContentDisposition,
+			ContentEncoding:    input.ContentEncoding,
+			ContentLanguage:    input.ContentLanguage,
+			ContentType:        input.ContentType,
+			Expires:            mockExpires(input.Expires),
+			StorageClass:       input.StorageClass,
+		},
+		parts: map[int64][]byte{},
+	}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (self *MockS3) CreateMultipartUploadRequest(input *s3.CreateMultipartUploadInput) (*request.Request, *s3.CreateMultipartUploadOutput) {
+	// required for s3manager.Upload
+	output, err := self.CreateMultipartUpload(input)
+	return mockRequest(err), output
+}
+
+func (self *MockS3) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	self.Lock()
+	defer self.Unlock()
+	upload, ok := self.uploads[*input.UploadId]
+	if !ok {
+		return nil, ErrNoSuchUpload
+	}
+	if self.fault("UploadPart", upload.bucket, upload.key) {
+		return nil, ErrSlowDown
+	}
+	content, _ := ioutil.ReadAll(input.Body)
+	upload.parts[*input.PartNumber] = content
+	sum := md5.Sum(content)
+	return &s3.UploadPartOutput{ETag: aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)}, nil
+}
 
-func (self *MockS3) AbortMultipartUploadRequest(*s3.AbortMultipartUploadInput) (*request.Request, *s3.AbortMultipartUploadOutput) {
-	return nil, &s3.AbortMultipartUploadOutput{}
+func (self *MockS3) UploadPartRequest(input *s3.UploadPartInput) (*request.Request, *s3.UploadPartOutput) {
+	output, err := self.UploadPart(input)
+	return mockRequest(err), output
 }
-func (self *MockS3) AbortMultipartUpload(*s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+
+func (self *MockS3) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	self.Lock()
+	defer self.Unlock()
+	upload, ok := self.uploads[*input.UploadId]
+	if !ok {
+		return nil, ErrNoSuchUpload
+	}
+	// the multipart etag is the md5 of the concatenated part md5s
+	var data []byte
+	h := md5.New()
+	for _, part := range input.MultipartUpload.Parts {
+		content := upload.parts[*part.PartNumber]
+		sum := md5.Sum(content)
+		h.Write(sum[:])
+		data = append(data, content...)
+	}
+	object := newMockObject(data, upload.metadata)
+	object.headers = upload.headers
+	object.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(h.Sum(nil)), len(input.MultipartUpload.Parts))
+	self.data[upload.bucket][upload.key] = object
+	delete(self.uploads, *input.UploadId)
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(object.etag)}, nil
+}
+
+func (self *MockS3) CompleteMultipartUploadRequest(input *s3.CompleteMultipartUploadInput) (*request.Request, *s3.CompleteMultipartUploadOutput) {
+	output, err := self.CompleteMultipartUpload(input)
+	return mockRequest(err), output
+}
+
+func (self *MockS3) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.uploads[*input.UploadId]; !ok {
+		return nil, ErrNoSuchUpload
+	}
+	delete(self.uploads, *input.UploadId)
 	return &s3.AbortMultipartUploadOutput{}, nil
 }
-func (self *MockS3) CompleteMultipartUploadRequest(*s3.CompleteMultipartUploadInput) (*request.Request, *s3.CompleteMultipartUploadOutput) {
-	return nil, &s3.CompleteMultipartUploadOutput{}
+
+func (self *MockS3) AbortMultipartUploadRequest(input *s3.AbortMultipartUploadInput) (*request.Request, *s3.AbortMultipartUploadOutput) {
+	output, err := self.AbortMultipartUpload(input)
+	return mockRequest(err), output
+}
+
+func (self *MockS3) ListParts(input *s3.ListPartsInput) (*s3.ListPartsOutput, error) {
+	self.RLock()
+	defer self.RUnlock()
+	upload, ok := self.uploads[*input.UploadId]
+	if !ok {
+		return nil, ErrNoSuchUpload
+	}
+	var numbers []int
+	for n := range upload.parts {
+		numbers = append(numbers, int(n))
+	}
+	sort.Ints(numbers)
+	output := s3.ListPartsOutput{IsTruncated: aws.Bool(false)}
+	for _, n := range numbers {
+		content := upload.parts[int64(n)]
+		sum := md5.Sum(content)
+		part := s3.Part{
+			PartNumber: aws.Int64(int64(n)),
+			ETag:       aws.String(`"` + hex.EncodeToString(sum[:]) + `"`),
+			Size:       aws.Int64(int64(len(content))),
+		}
+		output.Parts = append(output.Parts, &part)
+	}
+	return &output, nil
+}
+
+func (self *MockS3) ListMultipartUploads(input *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
+	self.RLock()
+	defer self.RUnlock()
+	if _, ok := self.data[*input.Bucket]; !ok {
+		return nil, ErrNoSuchBucket
+	}
+	var ids []string
+	for id, upload := range self.uploads {
+		if upload.bucket == *input.Bucket {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	output := s3.ListMultipartUploadsOutput{IsTruncated: aws.Bool(false)}
+	for _, id := range ids {
+		output.Uploads = append(output.Uploads, &s3.MultipartUpload{
+			Key:      aws.String(self.uploads[id].key),
+			UploadId: aws.String(id),
+		})
+	}
+	return &output, nil
 }
-func (self *MockS3) CompleteMultipartUpload(*s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
-	return &s3.CompleteMultipartUploadOutput{}, nil
+
+// mockRequest returns a request that has already been sent, with any error
+// pre-set.
+func mockRequest(err error) *request.Request {
+	req := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{}, nil, nil)
+	if err != nil {
+		req.Build()
+		req.Error = err
+	}
+	return req
 }
+
+// unimplemented
+
 func (self *MockS3) CopyObjectRequest(*s3.CopyObjectInput) (*request.Request, *s3.CopyObjectOutput) {
 	return nil, &s3.CopyObjectOutput{}
 }
-func (self *MockS3) CopyObject(*s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+
+// copySource returns the object named by a bucket/key copy source.
+func (self *MockS3) copySource(source string) (*MockObject, error) {
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(source, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid copy source: %s", source)
+	}
+	object, ok := self.data[parts[0]][parts[1]]
+	if !ok {
+		return nil, errors.New("NoSuchKey: The specified key does not exist")
+	}
+	return object, nil
+}
+
+func (self *MockS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	self.Lock()
+	defer self.Unlock()
+	object, err := self.copySource(*input.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	bucket, ok := self.data[*input.Bucket]
+	if !ok {
+		return nil, ErrNoSuchBucket
+	}
+	metadata, headers := object.metadata, object.headers
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		metadata = input.Metadata
+		headers = objectHeaders{
+			CacheControl:       input.CacheControl,
+			ContentDisposition: input.ContentDisposition,
+			ContentEncoding:    input.ContentEncoding,
+			ContentLanguage:    input.ContentLanguage,
+			ContentType:        input.ContentType,
+			Expires:            mockExpires(input.Expires),
+		}
+	}
+	headers.StorageClass = input.StorageClass
+	copied := newMockObject(object.data, metadata)
+	copied.headers = headers
+	bucket[*input.Key] = copied
 	return &s3.CopyObjectOutput{}, nil
 }
 func (self *MockS3) CreateBucketRequest(*s3.CreateBucketInput) (*request.Request, *s3.CreateBucketOutput) {
 	return nil, &s3.CreateBucketOutput{}
 }
-func (self *MockS3) CreateMultipartUploadRequest(*s3.CreateMultipartUploadInput) (*request.Request, *s3.CreateMultipartUploadOutput) {
-	return nil, &s3.CreateMultipartUploadOutput{}
-}
-func (self *MockS3) CreateMultipartUpload(*s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
-	return &s3.CreateMultipartUploadOutput{}, nil
-}
 func (self *MockS3) DeleteBucketRequest(*s3.DeleteBucketInput) (*request.Request, *s3.DeleteBucketOutput) {
 	return nil, &s3.DeleteBucketOutput{}
 }
@@ -273,9 +839,6 @@ func (self *MockS3) GetBucketLifecycleConfiguration(*s3.GetBucketLifecycleConfig
 func (self *MockS3) GetBucketLocationRequest(*s3.GetBucketLocationInput) (*request.Request, *s3.GetBucketLocationOutput) {
 	return nil, &s3.GetBucketLocationOutput{}
 }
-func (self *MockS3) GetBucketLocation(*s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
-	return &s3.GetBucketLocationOutput{}, nil
-}
 func (self *MockS3) GetBucketLoggingRequest(*s3.GetBucketLoggingInput) (*request.Request, *s3.GetBucketLoggingOutput) {
 	return nil, &s3.GetBucketLoggingOutput{}
 }
@@ -345,27 +908,18 @@ func (self *MockS3) GetObjectTorrentRequest(*s3.GetObjectTorrentInput) (*request
 func (self *MockS3) GetObjectTorrent(*s3.GetObjectTorrentInput) (*s3.GetObjectTorrentOutput, error) {
 	return &s3.GetObjectTorrentOutput{}, nil
 }
-func (self *MockS3) HeadBucketRequest(*s3.HeadBucketInput) (*request.Request, *s3.HeadBucketOutput) {
-	return nil, &s3.HeadBucketOutput{}
-}
 func (self *MockS3) HeadBucket(*s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
 	return &s3.HeadBucketOutput{}, nil
 }
 func (self *MockS3) HeadObjectRequest(*s3.HeadObjectInput) (*request.Request, *s3.HeadObjectOutput) {
 	return nil, &s3.HeadObjectOutput{}
 }
-func (self *MockS3) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
-	return &s3.HeadObjectOutput{}, nil
-}
 func (self *MockS3) ListBucketsRequest(*s3.ListBucketsInput) (*request.Request, *s3.ListBucketsOutput) {
 	return nil, &s3.ListBucketsOutput{}
 }
 func (self *MockS3) ListMultipartUploadsRequest(*s3.ListMultipartUploadsInput) (*request.Request, *s3.ListMultipartUploadsOutput) {
 	return nil, &s3.ListMultipartUploadsOutput{}
 }
-func (self *MockS3) ListMultipartUploads(*s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
-	return &s3.ListMultipartUploadsOutput{}, nil
-}
 func (self *MockS3) ListMultipartUploadsPages(*s3.ListMultipartUploadsInput, func(*s3.ListMultipartUploadsOutput, bool) bool) error {
 	return nil
 }
@@ -396,9 +950,6 @@ func (self *MockS3) ListObjectsV2Request(*s3.ListObjectsV2Input) (*request.Reque
 func (self *MockS3) ListPartsRequest(*s3.ListPartsInput) (*request.Request, *s3.ListPartsOutput) {
 	return nil, &s3.ListPartsOutput{}
 }
-func (self *MockS3) ListParts(*s3.ListPartsInput) (*s3.ListPartsOutput, error) {
-	return &s3.ListPartsOutput{}, nil
-}
 func (self *MockS3) ListPartsPages(*s3.ListPartsInput, func(*s3.ListPartsOutput, bool) bool) error {
 	return nil
 }
@@ -498,17 +1049,39 @@ func (self *MockS3) RestoreObjectRequest(*s3.RestoreObjectInput) (*request.Reque
 func (self *MockS3) RestoreObject(*s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
 	return &s3.RestoreObjectOutput{}, nil
 }
-func (self *MockS3) UploadPartRequest(*s3.UploadPartInput) (*request.Request, *s3.UploadPartOutput) {
-	return nil, &s3.UploadPartOutput{}
-}
-func (self *MockS3) UploadPart(*s3.UploadPartInput) (*s3.UploadPartOutput, error) {
-	return &s3.UploadPartOutput{}, nil
-}
 func (self *MockS3) UploadPartCopyRequest(*s3.UploadPartCopyInput) (*request.Request, *s3.UploadPartCopyOutput) {
 	return nil, &s3.UploadPartCopyOutput{}
 }
-func (self *MockS3) UploadPartCopy(*s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
-	return &s3.UploadPartCopyOutput{}, nil
+func (self *MockS3) UploadPartCopy(input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	self.count("UploadPartCopy")
+	if self.fault("UploadPartCopy", *input.Bucket, *input.Key) {
+		return nil, ErrSlowDown
+	}
+	self.Lock()
+	defer self.Unlock()
+	upload, ok := self.uploads[*input.UploadId]
+	if !ok {
+		return nil, ErrNoSuchUpload
+	}
+	object, err := self.copySource(*input.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	content := object.data
+	if input.CopySourceRange != nil {
+		var start, end int
+		_, err := fmt.Sscanf(*input.CopySourceRange, "bytes=%d-%d", &start, &end)
+		if err != nil || start > end || end >= len(content) {
+			return nil, fmt.Errorf("InvalidRange: %s", *input.CopySourceRange)
+		}
+		content = content[start : end+1]
+	}
+	upload.parts[*input.PartNumber] = content
+	sum := md5.Sum(content)
+	output := s3.UploadPartCopyOutput{
+		CopyPartResult: &s3.CopyPartResult{ETag: aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)},
+	}
+	return &output, nil
 }
 
 var _ s3iface.S3API = (*MockS3)(nil)
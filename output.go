@@ -0,0 +1,152 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// outputFormat is the format of command output, set by --output: text, or
+// records in json or ndjson.
+var outputFormat string
+
+// records counts the records written for --output json, streamed as the
+// elements of an array closed on exit.
+var records int
+var recordsLock sync.Mutex
+
+// outputFlag is a cli.Generic setting the output format.
+type outputFlag struct{}
+
+func (self *outputFlag) Set(value string) error {
+	switch value {
+	case "text", "json", "ndjson":
+	default:
+		return fmt.Errorf("output should be one of: text, json, ndjson")
+	}
+	outputFormat = value
+	if structured() {
+		// records replace the usual output
+		quiet = true
+	}
+	return nil
+}
+
+func (self *outputFlag) String() string {
+	return ""
+}
+
+// structured returns whether output is json or ndjson records.
+func structured() bool {
+	return outputFormat == "json" || outputFormat == "ndjson"
+}
+
+// emit outputs a record, if structured.
+func emit(record interface{}) {
+	recordsLock.Lock()
+	defer recordsLock.Unlock()
+	switch outputFormat {
+	case "json":
+		data, _ := json.MarshalIndent(record, "  ", "  ")
+		separator := ",\n  "
+		if records == 0 {
+			separator = "[\n  "
+		}
+		out.Write(append([]byte(separator), data...))
+		records++
+	case "ndjson":
+		data, _ := json.Marshal(record)
+		out.Write(append(data, '\n'))
+	}
+}
+
+// flushRecords closes the array of records written for --output json.
+func flushRecords() {
+	recordsLock.Lock()
+	defer recordsLock.Unlock()
+	if outputFormat != "json" || records == 0 {
+		return
+	}
+	out.Write([]byte("\n]\n"))
+	records = 0
+}
+
+// printError outputs an error that stops a command.
+func printError(err error) {
+	if structured() {
+		emit(errorRecord{err.Error()})
+	} else {
+		fmt.Fprintf(out, "Error: %s\n", err)
+	}
+}
+
+type errorRecord struct {
+	Error string `json:"error"`
+}
+
+type bucketRecord struct {
+	Bucket string `json:"bucket"`
+}
+
+type keyRecord struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	StorageClass string `json:"storage_class,omitempty"`
+}
+
+func newKeyRecord(file File) keyRecord {
+	record := keyRecord{Key: file.String(), Size: file.Size()}
+	if s, ok := file.(*S3File); ok {
+		record.ETag = s.etag()
+		record.StorageClass = aws.StringValue(s.object.StorageClass)
+		if s.object.LastModified != nil {
+			record.LastModified = s.object.LastModified.UTC().Format(time.RFC3339)
+		}
+	}
+	return record
+}
+
+type matchRecord struct {
+	Key  string `json:"key"`
+	Line string `json:"line,omitempty"`
+}
+
+type actionRecord struct {
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	Bytes  int64  `json:"bytes"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newActionRecord(action, key string, bytes int64, err error) actionRecord {
+	record := actionRecord{Action: action, Key: key, Bytes: bytes}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+type summaryRecord struct {
+	Summary interface{} `json:"summary"`
+}
+
+type syncSummary struct {
+	Added     int     `json:"added"`
+	Deleted   int     `json:"deleted"`
+	Updated   int     `json:"updated"`
+	Unchanged int     `json:"unchanged"`
+	Failed    int     `json:"failed"`
+	Bytes     int64   `json:"bytes"`
+	Seconds   float64 `json:"seconds"`
+	DryRun    bool    `json:"dry_run"`
+}
+
+type listSummary struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
@@ -0,0 +1,216 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// plan collects the actions of the current sync, if writing a plan.
+var plan *syncPlan
+
+// syncPlan is the list of actions a sync would take, written by
+// --plan-out for review and carried out later by apply.
+type syncPlan struct {
+	Source      string       `json:"source"`
+	Destination string       `json:"destination"`
+	Actions     []planAction `json:"actions"`
+	fs1, fs2    Filesystem
+}
+
+type planAction struct {
+	Action      string `json:"action"`
+	Path        string `json:"path"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination"`
+	Size        int64  `json:"size"`
+	ModTime     string `json:"mtime,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	Reason      string `json:"reason"`
+}
+
+// fileVersion returns what identifies the contents of file besides its
+// size: the modification time of a local file, or the etag of an object.
+func fileVersion(file File) (string, string) {
+	switch t := file.(type) {
+	case *LocalFile:
+		return t.ModTime().UTC().Format(time.RFC3339Nano), ""
+	case *S3File:
+		return "", t.etag()
+	}
+	return "", ""
+}
+
+// location returns the full path or url of relpath in fs.
+func location(fs Filesystem, relpath string) string {
+	switch t := fs.(type) {
+	case *S3Filesystem:
+		return fmt.Sprintf("s3://%s/%s", t.bucket, t.key(relpath))
+	case *LocalFilesystem:
+		return t.fullpath(relpath)
+	}
+	return relpath
+}
+
+// Add records an action in the plan.
+func (self *syncPlan) Add(action Action) {
+	if self == nil {
+		return
+	}
+	relpath := action.File.Relative()
+	record := planAction{
+		Action:      action.Action,
+		Path:        relpath,
+		Destination: location(self.fs2, relpath),
+		Size:        action.File.Size(),
+		Reason:      action.Reason,
+	}
+	record.ModTime, record.ETag = fileVersion(action.File)
+	if action.Action != "delete" {
+		record.Source = location(self.fs1, relpath)
+	}
+	self.Actions = append(self.Actions, record)
+}
+
+func (self *syncPlan) Save(filename string) error {
+	if self.Actions == nil {
+		self.Actions = []planAction{}
+	}
+	data, err := json.MarshalIndent(self, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0666)
+}
+
+// withPlan runs a sync of src to dest writing its actions to a plan
+// instead of performing them, if enabled.
+func withPlan(conn s3iface.S3API, src, dest string, fn func() error) error {
+	if planOut == "" {
+		return fn()
+	}
+	plan = &syncPlan{
+		Source:      src,
+		Destination: dest,
+		fs1:         sideFilesystem(conn, srcSettings, src),
+		fs2:         sideFilesystem(conn, destSettings, dest),
+	}
+	defer func(value bool) {
+		dryRun = value
+		plan = nil
+	}(dryRun)
+	dryRun = true
+	err := fn()
+	if err != nil {
+		return err
+	}
+	return plan.Save(planOut)
+}
+
+func readPlan(filename string) (*syncPlan, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var plan syncPlan
+	err = json.Unmarshal(data, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return &plan, nil
+}
+
+// planFiles finds the files in fs at the given relative paths.
+func planFiles(fs Filesystem, paths map[string]bool) (map[string]File, error) {
+	files := map[string]File{}
+	if len(paths) == 0 {
+		return files, nil
+	}
+	for file := range fs.Files() {
+		if paths[file.Relative()] {
+			files[file.Relative()] = file
+		}
+	}
+	return files, fs.Error()
+}
+
+// applyPlan performs the actions in a plan written by sync --plan-out. The
+// plan is checked against the current files before anything is changed.
+func applyPlan(conn s3iface.S3API, filename string) error {
+	start := time.Now()
+	p, err := readPlan(filename)
+	if err != nil {
+		return err
+	}
+	fs1 := sideFilesystem(conn, srcSettings, p.Source)
+	fs2 := sideFilesystem(conn, destSettings, p.Destination)
+
+	srcPaths := map[string]bool{}
+	destPaths := map[string]bool{}
+	for _, a := range p.Actions {
+		switch a.Action {
+		case "create", "update":
+			srcPaths[a.Path] = true
+		case "delete":
+			destPaths[a.Path] = true
+		default:
+			return fmt.Errorf("%s: unknown action %q", filename, a.Action)
+		}
+	}
+	srcFiles, err := planFiles(fs1, srcPaths)
+	if err != nil {
+		return err
+	}
+	destFiles, err := planFiles(fs2, destPaths)
+	if err != nil {
+		return err
+	}
+
+	tracker := startProgress()
+	defer tracker.Stop()
+	var actions []Action
+	var counts syncCounts
+	for _, a := range p.Actions {
+		fs, files := fs1, srcFiles
+		switch a.Action {
+		case "create":
+			counts.added += 1
+		case "update":
+			counts.updated += 1
+		case "delete":
+			fs, files = fs2, destFiles
+			counts.deleted += 1
+		}
+		file, ok := files[a.Path]
+		if !ok {
+			return fmt.Errorf("%s no longer exists", location(fs, a.Path))
+		}
+		mtime, etag := fileVersion(file)
+		if file.Size() != a.Size || mtime != a.ModTime || etag != a.ETag {
+			return fmt.Errorf("%s has changed since the plan was made", location(fs, a.Path))
+		}
+		actions = append(actions, Action{a.Action, file, a.Reason})
+		if a.Action == "delete" {
+			progress.add(0)
+		} else {
+			progress.add(a.Size)
+		}
+	}
+	progress.complete()
+
+	q, wait := startActions(fs2)
+	for _, action := range actions {
+		q <- action
+	}
+	counts.failed = wait()
+	tracker.Stop()
+	counts.bytes = tracker.Transferred()
+
+	end := time.Now()
+	took := end.Sub(start)
+	summary(counts, took)
+	return counts.failures()
+}
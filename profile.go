@@ -0,0 +1,199 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/go-ini/ini"
+	"github.com/urfave/cli"
+)
+
+// profile is the named profile of the shared AWS config and credentials
+// files, and of the s3 config file.
+var profile string
+
+// configAliases are the names accepted in the s3 config file for short
+// options.
+var configAliases = map[string]string{
+	"parallel": "p",
+	"dry-run":  "n",
+	"quiet":    "q",
+}
+
+// homeFile returns the path of name in the home directory, unless set by
+// the environment variable env.
+func homeFile(env string, name ...string) string {
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(append([]string{home}, name...)...)
+}
+
+// loadSection returns the first of sections found in the ini file, if any.
+func loadSection(filename string, sections ...string) (*ini.Section, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil, nil
+	}
+	f, err := ini.Load(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	for _, name := range sections {
+		if section, err := f.GetSection(name); err == nil {
+			return section, nil
+		}
+	}
+	return nil, nil
+}
+
+func profileName() string {
+	if profile == "" {
+		return "default"
+	}
+	return profile
+}
+
+// configFile is the path of the s3 config file.
+func configFile() string {
+	return homeFile("S3_CONFIG_FILE", ".config", "s3", "config")
+}
+
+func awsConfigFile() string {
+	return homeFile("AWS_CONFIG_FILE", ".aws", "config")
+}
+
+func awsCredentialsFile() string {
+	return homeFile("AWS_SHARED_CREDENTIALS_FILE", ".aws", "credentials")
+}
+
+// checkProfile returns an error if the profile isn't in any config file.
+func checkProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	files := map[string][]string{
+		awsConfigFile():      {"profile " + name, name},
+		awsCredentialsFile(): {name},
+		configFile():         {"profile " + name, name},
+	}
+	for filename, sections := range files {
+		section, err := loadSection(filename, sections...)
+		if err != nil {
+			return err
+		}
+		if section != nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("profile %s not found", name)
+}
+
+// awsSetting returns a setting of the profile from the shared AWS config
+// or credentials files.
+func awsSetting(name, key string) (string, error) {
+	if name == "" {
+		name = "default"
+	}
+	config, err := loadSection(awsConfigFile(), "profile "+name, name)
+	if err != nil {
+		return "", err
+	}
+	if config != nil && config.HasKey(key) {
+		return config.Key(key).String(), nil
+	}
+	creds, err := loadSection(awsCredentialsFile(), name)
+	if err != nil || creds == nil {
+		return "", err
+	}
+	return creds.Key(key).String(), nil
+}
+
+// applyConfig sets options from the profile's section of the s3 config
+// file, unless set on the command line or by environment variables.
+func applyConfig(c *cli.Context, flags []cli.Flag) error {
+	filename := configFile()
+	name := profileName()
+	section, err := loadSection(filename, "profile "+name, name)
+	if err != nil || section == nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, flag := range flags {
+		names[flag.GetName()] = true
+	}
+	for _, key := range section.Keys() {
+		option := key.Name()
+		if alias, ok := configAliases[option]; ok {
+			option = alias
+		}
+		if !names[option] || c.IsSet(option) {
+			continue
+		}
+		err := c.Set(option, key.String())
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", filename, key.Name(), err)
+		}
+	}
+	return nil
+}
+
+// processProvider gets credentials from the output of a credential_process
+// command.
+type processProvider struct {
+	command    string
+	expiration time.Time
+}
+
+func (self *processProvider) Retrieve() (credentials.Value, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", self.command)
+	} else {
+		cmd = exec.Command("sh", "-c", self.command)
+	}
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("credential_process: %s", err)
+	}
+	var result struct {
+		Version         int
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      *time.Time
+	}
+	err = json.Unmarshal(output, &result)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("credential_process: %s", err)
+	}
+	if result.Version != 1 || result.AccessKeyId == "" || result.SecretAccessKey == "" {
+		return credentials.Value{}, fmt.Errorf("credential_process: invalid credentials")
+	}
+	self.expiration = time.Time{}
+	if result.Expiration != nil {
+		self.expiration = *result.Expiration
+	}
+	return credentials.Value{
+		AccessKeyID:     result.AccessKeyId,
+		SecretAccessKey: result.SecretAccessKey,
+		SessionToken:    result.SessionToken,
+		ProviderName:    "ProcessProvider",
+	}, nil
+}
+
+// IsExpired returns whether the credentials have expired, refreshing them
+// a minute early.
+func (self *processProvider) IsExpired() bool {
+	return !self.expiration.IsZero() && time.Now().Add(time.Minute).After(self.expiration)
+}
@@ -0,0 +1,264 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progress tracks the transfers of the current get, put or sync.
+var progress *progressTracker
+
+const (
+	// progressRedraw is how often the progress bar is redrawn on a terminal
+	progressRedraw = 200 * time.Millisecond
+	// defaultProgressInterval is how often progress is logged otherwise
+	defaultProgressInterval = 10 * time.Second
+	progressBarWidth        = 20
+)
+
+var progressInterval = defaultProgressInterval
+
+// progressTracker counts files and bytes done out of the totals so far,
+// drawing a progress bar on a terminal or logging periodically.
+type progressTracker struct {
+	sync.Mutex
+	files, totalFiles int
+	bytes, totalBytes int64
+	// listed is set once the totals are complete
+	listed bool
+	// rate is the recent bytes per second, sampled from bytes at last
+	rate       float64
+	last       int64
+	sampled    time.Time
+	tty, drawn bool
+	// progress is written to writer, usually stderr, keeping it out of the
+	// output
+	writer, out io.Writer
+	stop        chan bool
+	stopped     bool
+}
+
+// isTerminal returns whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress starts tracking progress, displaying it unless -q.
+func startProgress() *progressTracker {
+	progress = &progressTracker{
+		sampled: time.Now(),
+		writer:  err,
+		out:     out,
+		stop:    make(chan bool),
+	}
+	if !quiet {
+		interval := progressInterval
+		if isTerminal(err) {
+			progress.tty = true
+			interval = progressRedraw
+			// keep the bar below output
+			out = progressWriter{progress}
+		}
+		go progress.run(interval)
+	}
+	return progress
+}
+
+func (self *progressTracker) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+			self.Lock()
+			self.sample()
+			if self.tty {
+				self.clear()
+				self.draw()
+			} else {
+				fmt.Fprintf(self.writer, "progress: %s\n", self.status())
+			}
+			self.Unlock()
+		}
+	}
+}
+
+// Stop stops displaying progress, clearing any progress bar.
+func (self *progressTracker) Stop() {
+	self.Lock()
+	defer self.Unlock()
+	if self.stopped {
+		return
+	}
+	self.stopped = true
+	close(self.stop)
+	if self.tty {
+		self.clear()
+		out = self.out
+	}
+	progress = nil
+}
+
+// add counts another file to transfer, of size bytes.
+func (self *progressTracker) add(size int64) {
+	if self == nil {
+		return
+	}
+	self.Lock()
+	self.totalFiles += 1
+	self.totalBytes += size
+	self.Unlock()
+}
+
+// done counts a file as finished.
+func (self *progressTracker) done() {
+	if self == nil {
+		return
+	}
+	self.Lock()
+	self.files += 1
+	self.Unlock()
+}
+
+// complete marks the totals as complete, once all files are listed.
+func (self *progressTracker) complete() {
+	if self == nil {
+		return
+	}
+	self.Lock()
+	self.listed = true
+	self.Unlock()
+}
+
+// transfer counts n bytes transferred.
+func (self *progressTracker) transfer(n int64) {
+	if self == nil {
+		return
+	}
+	self.Lock()
+	self.bytes += n
+	self.Unlock()
+}
+
+// Transferred returns the bytes transferred so far.
+func (self *progressTracker) Transferred() int64 {
+	self.Lock()
+	defer self.Unlock()
+	return self.bytes
+}
+
+// reader wraps reader to count the bytes read as transferred.
+func (self *progressTracker) reader(reader io.ReadCloser) io.ReadCloser {
+	if self == nil {
+		return reader
+	}
+	return keepSeeker(reader, &countingReader{reader, self})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	progress *progressTracker
+}
+
+func (self *countingReader) Read(p []byte) (int, error) {
+	n, err := self.ReadCloser.Read(p)
+	self.progress.transfer(int64(n))
+	return n, err
+}
+
+// sample updates the recent rate, smoothing out bursts.
+func (self *progressTracker) sample() {
+	now := time.Now()
+	rate := float64(self.bytes-self.last) / now.Sub(self.sampled).Seconds()
+	if self.rate == 0 {
+		self.rate = rate
+	} else {
+		self.rate = 0.7*self.rate + 0.3*rate
+	}
+	self.last = self.bytes
+	self.sampled = now
+}
+
+// status describes the progress so far.
+func (self *progressTracker) status() string {
+	more := ""
+	if !self.listed {
+		more = "+"
+	}
+	bytes := self.bytes
+	if bytes > self.totalBytes {
+		// retried transfers count twice
+		bytes = self.totalBytes
+	}
+	s := fmt.Sprintf("%d/%d%s files, %s/%s%s, %s/s", self.files, self.totalFiles, more,
+		formatBytes(float64(bytes)), formatBytes(float64(self.totalBytes)), more, formatBytes(self.rate))
+	if self.listed && self.rate > 0 {
+		eta := time.Duration(float64(self.totalBytes-bytes) / self.rate * float64(time.Second))
+		s += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	if n := concurrency.current(); n > 0 {
+		s += fmt.Sprintf(", concurrency %d", n)
+	}
+	return s
+}
+
+func (self *progressTracker) draw() {
+	fraction := 0.0
+	if self.totalBytes > 0 {
+		fraction = float64(self.bytes) / float64(self.totalBytes)
+	} else if self.totalFiles > 0 {
+		fraction = float64(self.files) / float64(self.totalFiles)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	n := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", n) + strings.Repeat(" ", progressBarWidth-n)
+	fmt.Fprintf(self.writer, "[%s] %s", bar, self.status())
+	self.drawn = true
+}
+
+func (self *progressTracker) clear() {
+	if self.drawn {
+		fmt.Fprint(self.writer, "\r\033[K")
+		self.drawn = false
+	}
+}
+
+// progressWriter writes output above the progress bar.
+type progressWriter struct {
+	progress *progressTracker
+}
+
+func (self progressWriter) Write(p []byte) (int, error) {
+	self.progress.Lock()
+	defer self.progress.Unlock()
+	self.progress.clear()
+	n, err := self.progress.out.Write(p)
+	self.progress.draw()
+	return n, err
+}
+
+// formatBytes formats a number of bytes in B, KB, MB, GB or TB.
+func formatBytes(n float64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", int64(n))
+	}
+	units := "KMGT"
+	i := 0
+	for n /= 1024; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	return fmt.Sprintf("%.1f %cB", n, units[i])
+}
@@ -0,0 +1,167 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxRetryBackoff caps the exponential backoff between attempts.
+const maxRetryBackoff = 30 * time.Second
+
+// retryableCodes are the S3 error codes worth retrying.
+var retryableCodes = map[string]bool{
+	"InternalError":             true,
+	"RequestError":              true,
+	"RequestLimitExceeded":      true,
+	"RequestThrottled":          true,
+	"RequestTimeout":            true,
+	"ServiceUnavailable":        true,
+	"SlowDown":                  true,
+	"Throttling":                true,
+	"ThrottlingException":       true,
+	"TooManyRequests":           true,
+	"OperationAborted":          true,
+	"BadDigest":                 true,
+	"IncompleteBody":            true,
+	"XAmzContentSHA256Mismatch": true,
+}
+
+// retryable returns whether err is likely transient, so the operation
+// should be retried.
+func retryable(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if e, ok := err.(awserr.RequestFailure); ok {
+		switch e.StatusCode() {
+		case 500, 502, 503, 504:
+			return true
+		}
+	}
+	if e, ok := err.(awserr.Error); ok {
+		if retryableCodes[e.Code()] {
+			return true
+		}
+		return e.OrigErr() != nil && retryable(e.OrigErr())
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	if e, ok := err.(net.Error); ok {
+		return e.Timeout() || e.Temporary()
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before the given retry, doubling
+// each time with up to --retry-jitter of it randomised.
+func retryDelay(retry int) time.Duration {
+	delay := retryBackoff
+	for i := 1; i < retry && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return time.Duration(float64(delay) * (1 - retryJitter*rand.Float64()))
+}
+
+// withRetry calls fn, retrying transient errors up to --retries times.
+func withRetry(fn func() error) error {
+	for retry := 1; ; retry++ {
+		err := fn()
+		if throttling(err) {
+			concurrency.throttled()
+		}
+		if err == nil || retry > retries || !retryable(err) {
+			return err
+		}
+		time.Sleep(retryDelay(retry))
+	}
+}
+
+// resumingReader reads an object, resuming from the last received byte if
+// the download fails part way.
+type resumingReader struct {
+	file   *S3File
+	body   io.ReadCloser
+	etag   *string
+	offset int64
+	size   int64
+	// failed counts resumes without receiving any data
+	failed int
+}
+
+// open requests the object from the current offset, checking it is
+// unchanged when resuming.
+func (self *resumingReader) open() error {
+	input := s3.GetObjectInput{
+		Bucket:  aws.String(self.file.bucket),
+		Key:     self.file.object.Key,
+		IfMatch: self.etag,
+	}
+	if self.offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", self.offset))
+	}
+	output, err := self.file.conn.GetObject(&input)
+	if err != nil {
+		return err
+	}
+	if self.etag == nil {
+		self.etag = output.ETag
+		self.size = aws.Int64Value(output.ContentLength)
+		if self.file.metadata == nil {
+			// save a head request for the metadata later
+			self.file.setMetadata(output.Metadata, objectHeaders{
+				CacheControl:       output.CacheControl,
+				ContentDisposition: output.ContentDisposition,
+				ContentEncoding:    output.ContentEncoding,
+				ContentLanguage:    output.ContentLanguage,
+				ContentType:        output.ContentType,
+				Expires:            output.Expires,
+				StorageClass:       output.StorageClass,
+			})
+		}
+	}
+	self.body = output.Body
+	return nil
+}
+
+func (self *resumingReader) Read(p []byte) (int, error) {
+	n, err := self.body.Read(p)
+	self.offset += int64(n)
+	if err == io.EOF && self.offset < self.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil || err == io.EOF || !retryable(err) {
+		return n, err
+	}
+	if n > 0 {
+		self.failed = 0
+	} else {
+		self.failed += 1
+	}
+	if self.failed > retries {
+		return n, err
+	}
+	self.body.Close()
+	time.Sleep(retryDelay(self.failed + 1))
+	err = withRetry(self.open)
+	if err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (self *resumingReader) Close() error {
+	return self.body.Close()
+}
@@ -1,32 +1,82 @@
 package s3
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
+	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type S3Filesystem struct {
-	err    error
-	conn   s3iface.S3API
-	bucket string
-	path   string
+	err      error
+	conn     s3iface.S3API
+	settings connSettings
+	bucket   string
+	path     string
 }
 
 type S3File struct {
-	conn   s3iface.S3API
-	bucket string
-	object *s3.Object
-	path   string
-	md5    []byte
+	conn     s3iface.S3API
+	settings connSettings
+	bucket   string
+	object   *s3.Object
+	path     string
+	md5      []byte
+	metadata map[string]*string
+	headers  objectHeaders
+}
+
+// objectHeaders are the content headers of an object, kept when it is
+// copied or streamed to another bucket.
+type objectHeaders struct {
+	CacheControl       *string
+	ContentDisposition *string
+	ContentEncoding    *string
+	ContentLanguage    *string
+	ContentType        *string
+	Expires            *string
+	StorageClass       *string
+}
+
+// user metadata recorded on multipart uploads, as their etag is not an md5
+const (
+	metaPartSize = "part-size"
+	metaMD5      = "md5"
+)
+
+// user metadata recording local file attributes, restored on download
+const (
+	metaMtime   = "mtime"
+	metaMode    = "mode"
+	metaSymlink = "symlink"
+)
+
+// partSizeFor returns the multipart upload part size used for a file of
+// the given size, growing the part size to stay within the part limit.
+func partSizeFor(size int64) int64 {
+	partSize := int64(partSizeMB) * 1024 * 1024
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+	if size/partSize >= s3manager.MaxUploadParts {
+		partSize = size/s3manager.MaxUploadParts + 1
+	}
+	return partSize
 }
 
 func (self *S3File) Relative() string {
@@ -37,29 +87,163 @@ func (self *S3File) Size() int64 {
 	return *self.object.Size
 }
 
+func (self *S3File) ModTime() time.Time {
+	if self.object.LastModified == nil {
+		return time.Time{}
+	}
+	return *self.object.LastModified
+}
+
 func (self *S3File) IsDirectory() bool {
 	return strings.HasSuffix(self.path, "/") && *self.object.Size == 0
 }
 
-func (self *S3File) MD5() []byte {
-	if self.md5 == nil {
-		etag := *self.object.ETag
-		v := etag[1 : len(etag)-1]
-		self.md5, _ = hex.DecodeString(v)
+func (self *S3File) etag() string {
+	if self.object.ETag == nil {
+		return ""
 	}
-	return self.md5
+	return strings.Trim(*self.object.ETag, `"`)
 }
 
-func (self *S3File) Reader() (io.ReadCloser, error) {
-	input := s3.GetObjectInput{
+// multipart returns whether the object was uploaded in parts, in which case
+// its etag is of the form "md5-of-part-md5s-partcount".
+func (self *S3File) multipart() bool {
+	return strings.Contains(self.etag(), "-")
+}
+
+// head fetches the user metadata and content headers, which are not
+// included in listings.
+func (self *S3File) head() error {
+	if self.metadata != nil {
+		return nil
+	}
+	input := s3.HeadObjectInput{
 		Bucket: aws.String(self.bucket),
 		Key:    self.object.Key,
 	}
-	output, err := self.conn.GetObject(&input)
+	output, err := self.conn.HeadObject(&input)
+	if err != nil {
+		return err
+	}
+	self.setMetadata(output.Metadata, objectHeaders{
+		CacheControl:       output.CacheControl,
+		ContentDisposition: output.ContentDisposition,
+		ContentEncoding:    output.ContentEncoding,
+		ContentLanguage:    output.ContentLanguage,
+		ContentType:        output.ContentType,
+		Expires:            output.Expires,
+		StorageClass:       output.StorageClass,
+	})
+	return nil
+}
+
+// setMetadata records the user metadata and content headers, from either a
+// head or get request.
+func (self *S3File) setMetadata(metadata map[string]*string, headers objectHeaders) {
+	self.metadata = map[string]*string{}
+	for k, v := range metadata {
+		self.metadata[k] = v
+	}
+	if headers.StorageClass == nil {
+		// omitted for the standard class, but included in listings
+		headers.StorageClass = self.object.StorageClass
+	}
+	self.headers = headers
+}
+
+// copyMetadata sets the content headers and user metadata of input to
+// those of the object, except the part size and md5 which are for the
+// upload to record.
+func (self *S3File) copyMetadata(input *s3manager.UploadInput) error {
+	err := self.head()
+	if err != nil {
+		return err
+	}
+	input.CacheControl = self.headers.CacheControl
+	input.ContentDisposition = self.headers.ContentDisposition
+	input.ContentEncoding = self.headers.ContentEncoding
+	input.ContentLanguage = self.headers.ContentLanguage
+	if self.headers.ContentType != nil {
+		input.ContentType = self.headers.ContentType
+	}
+	if self.headers.Expires != nil {
+		if t, err := http.ParseTime(*self.headers.Expires); err == nil {
+			input.Expires = &t
+		}
+	}
+	input.StorageClass = self.headers.StorageClass
+	for k, v := range self.metadata {
+		if !strings.EqualFold(k, metaPartSize) && !strings.EqualFold(k, metaMD5) {
+			input.Metadata[k] = v
+		}
+	}
+	return nil
+}
+
+// meta returns the user metadata value for name, or "" if unset.
+func (self *S3File) meta(name string) (string, error) {
+	err := self.head()
+	if err != nil {
+		return "", err
+	}
+	for k, v := range self.metadata {
+		if strings.EqualFold(k, name) && v != nil {
+			return *v, nil
+		}
+	}
+	return "", nil
+}
+
+// partSize returns the part size the object was uploaded with.
+func (self *S3File) partSize() (int64, error) {
+	v, err := self.meta(metaPartSize)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+		return n, nil
+	}
+	return partSizeFor(self.Size()), nil
+}
+
+func (self *S3File) MD5() ([]byte, error) {
+	if self.md5 == nil {
+		if self.multipart() {
+			// fallback to the md5 recorded on upload, if any
+			v, err := self.meta(metaMD5)
+			if err != nil {
+				return nil, err
+			}
+			if v != "" {
+				self.md5, _ = hex.DecodeString(v)
+			}
+		} else {
+			self.md5, _ = hex.DecodeString(self.etag())
+		}
+	}
+	return self.md5, nil
+}
+
+func (self *S3File) Reader() (io.ReadCloser, error) {
+	reader := &resumingReader{file: self}
+	err := withRetry(reader.open)
 	if err != nil {
 		return nil, err
 	}
-	return output.Body, err
+	return limit(reader, downloadLimit), nil
+}
+
+// mtime returns the modification time recorded when uploaded from a local
+// file, otherwise when the object was last modified.
+func (self *S3File) mtime() (time.Time, error) {
+	v, err := self.meta(metaMtime)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	return self.ModTime(), nil
 }
 
 func (self *S3File) Delete() error {
@@ -67,8 +251,10 @@ func (self *S3File) Delete() error {
 		Bucket: aws.String(self.bucket),
 		Key:    self.object.Key,
 	}
-	_, err := self.conn.DeleteObject(&input)
-	return err
+	return withRetry(func() error {
+		_, err := self.conn.DeleteObject(&input)
+		return err
+	})
 }
 
 func (self *S3File) String() string {
@@ -80,11 +266,27 @@ func (self *S3Filesystem) Error() error {
 }
 
 func (self *S3Filesystem) Files() <-chan File {
+	return self.list(self.path, nil)
+}
+
+func (self *S3Filesystem) FilesUnder(relpath string) <-chan File {
+	relpath = filepath.ToSlash(relpath)
+	prefix := self.path[:self.stripLen()] + relpath
+	return self.list(prefix, func(rel string) bool {
+		return rel == relpath || strings.HasPrefix(rel, relpath+"/")
+	})
+}
+
+// stripLen is the length of the key prefix not included in relative paths.
+func (self *S3Filesystem) stripLen() int {
+	return strings.LastIndex(self.path, "/") + 1
+}
+
+// list lists keys under prefix, optionally only those whose relative path
+// matches.
+func (self *S3Filesystem) list(prefix string, match func(relpath string) bool) <-chan File {
 	ch := make(chan File, 1000)
-	stripLen := strings.LastIndex(self.path, "/") + 1
-	if stripLen == -1 {
-		stripLen = 0
-	}
+	stripLen := self.stripLen()
 	go func() {
 		defer close(ch)
 		truncated := true
@@ -92,7 +294,7 @@ func (self *S3Filesystem) Files() <-chan File {
 		for truncated {
 			input := s3.ListObjectsInput{
 				Bucket: aws.String(self.bucket),
-				Prefix: aws.String(self.path),
+				Prefix: aws.String(prefix),
 				Marker: aws.String(marker),
 			}
 			output, err := self.conn.ListObjects(&input)
@@ -103,7 +305,9 @@ func (self *S3Filesystem) Files() <-chan File {
 			for _, c := range output.Contents {
 				key := c
 				relpath := (*key.Key)[stripLen:]
-				ch <- &S3File{self.conn, self.bucket, key, relpath, nil}
+				if match == nil || match(relpath) {
+					ch <- &S3File{conn: self.conn, settings: self.settings, bucket: self.bucket, object: key, path: relpath}
+				}
 				marker = *c.Key
 			}
 			truncated = *output.IsTruncated
@@ -120,48 +324,393 @@ func guessMimeType(filename string) string {
 	return ext
 }
 
-func (self *S3Filesystem) Create(src File) error {
-	var fullpath string
+// key returns the key a file at relpath is created as.
+func (self *S3Filesystem) key(relpath string) string {
 	if self.path == "" || strings.HasSuffix(self.path, "/") {
-		fullpath = filepath.Join(self.path, src.Relative())
-	} else {
-		fullpath = self.path
+		return filepath.Join(self.path, relpath)
 	}
+	return self.path
+}
+
+func (self *S3Filesystem) Create(src File) error {
+	return withRetry(func() error {
+		return self.create(src)
+	})
+}
+
+func (self *S3Filesystem) create(src File) error {
+	fullpath := self.key(src.Relative())
 	input := s3manager.UploadInput{
 		ACL:    aws.String(acl),
 		Bucket: aws.String(self.bucket),
 		Key:    aws.String(fullpath),
 	}
 
+	if t, ok := src.(*S3File); ok && t.settings.account() == self.settings.account() {
+		// copy server-side rather than streaming through, unless the
+		// source is on another account or server
+		err := self.copy(t, fullpath)
+		if err == nil {
+			progress.transfer(t.Size())
+		}
+		return err
+	}
+
+	reader, err := src.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	input.Body = limit(progress.reader(reader), uploadLimit)
+	input.ContentType = aws.String(guessMimeType(src.Relative()))
+	input.Metadata = map[string]*string{}
 	switch t := src.(type) {
+	case *LocalFile:
+		input.Metadata[metaMtime] = aws.String(t.ModTime().UTC().Format(time.RFC3339Nano))
+		input.Metadata[metaMode] = aws.String(fmt.Sprintf("%04o", t.info.Mode().Perm()))
+		if t.link != "" {
+			input.Metadata[metaSymlink] = aws.String(t.link)
+		}
 	case *S3File:
-		// special case for S3File to preserve header information
-		getObjectInput := s3.GetObjectInput{
-			Bucket: aws.String(t.bucket),
-			Key:    t.object.Key,
+		err := t.copyMetadata(&input)
+		if err != nil {
+			return err
+		}
+	}
+
+	partSize := partSizeFor(src.Size())
+	if src.Size() > partSize {
+		// multipart etags can't be compared with an md5, so record the part
+		// size and md5 for later syncs
+		input.Metadata[metaPartSize] = aws.String(strconv.FormatInt(partSize, 10))
+		sum, err := src.MD5()
+		if err != nil {
+			return err
+		}
+		if sum != nil {
+			input.Metadata[metaMD5] = aws.String(hex.EncodeToString(sum))
+		}
+	}
+
+	if journal != nil && src.Size() > partSize {
+		return self.uploadParts(&input, src, partSize)
+	}
+
+	u := s3manager.NewUploaderWithClient(self.conn, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+	})
+	_, err = u.Upload(&input)
+	return err
+}
+
+// maxCopySize is the largest object that can be copied in a single request.
+var maxCopySize int64 = defaultMaxCopySize
+
+const defaultMaxCopySize = 5 * 1024 * 1024 * 1024
+
+// copy copies src to key server-side, preserving its headers and metadata:
+// Cache-Control, Content-Disposition, Content-Encoding, Content-Type,
+// Expires and any user metadata.
+func (self *S3Filesystem) copy(src *S3File, key string) error {
+	source := url.URL{Path: src.bucket + "/" + *src.object.Key}
+	if src.Size() <= maxCopySize {
+		input := s3.CopyObjectInput{
+			ACL:          aws.String(acl),
+			Bucket:       aws.String(self.bucket),
+			Key:          aws.String(key),
+			CopySource:   aws.String(source.EscapedPath()),
+			StorageClass: src.object.StorageClass,
+		}
+		_, err := self.conn.CopyObject(&input)
+		return err
+	}
+	return self.copyParts(src, key, source.EscapedPath())
+}
+
+// copyParts copies src to key in parallel parts, for objects too large to
+// copy in one request.
+func (self *S3Filesystem) copyParts(src *S3File, key, source string) error {
+	headInput := s3.HeadObjectInput{
+		Bucket: aws.String(src.bucket),
+		Key:    src.object.Key,
+	}
+	head, err := self.conn.HeadObject(&headInput)
+	if err != nil {
+		return err
+	}
+	size := src.Size()
+	partSize := partSizeFor(size)
+	metadata := map[string]*string{}
+	for k, v := range head.Metadata {
+		metadata[k] = v
+	}
+	// the copy's etag is of our part size, though any md5 still holds
+	for k := range metadata {
+		if strings.EqualFold(k, metaPartSize) {
+			delete(metadata, k)
+		}
+	}
+	metadata[metaPartSize] = aws.String(strconv.FormatInt(partSize, 10))
+
+	createInput := s3.CreateMultipartUploadInput{
+		ACL:                aws.String(acl),
+		Bucket:             aws.String(self.bucket),
+		Key:                aws.String(key),
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentType:        head.ContentType,
+		Metadata:           metadata,
+		StorageClass:       head.StorageClass,
+	}
+	if head.Expires != nil {
+		if t, err := http.ParseTime(*head.Expires); err == nil {
+			createInput.Expires = &t
+		}
+	}
+	output, err := self.conn.CreateMultipartUpload(&createInput)
+	if err != nil {
+		return err
+	}
+	uploadId := output.UploadId
+
+	numParts := (size + partSize - 1) / partSize
+	parts := make([]*s3.CompletedPart, numParts)
+	numbers := make(chan int64)
+	errs := make(chan error, s3manager.DefaultUploadConcurrency)
+	for i := 0; i < s3manager.DefaultUploadConcurrency; i += 1 {
+		go func() {
+			var err error
+			for n := range numbers {
+				if err != nil {
+					// drain after an error
+					continue
+				}
+				start := (n - 1) * partSize
+				end := start + partSize - 1
+				if end >= size {
+					end = size - 1
+				}
+				input := s3.UploadPartCopyInput{
+					Bucket:          aws.String(self.bucket),
+					Key:             aws.String(key),
+					UploadId:        uploadId,
+					PartNumber:      aws.Int64(n),
+					CopySource:      aws.String(source),
+					CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+				}
+				var output *s3.UploadPartCopyOutput
+				output, err = self.conn.UploadPartCopy(&input)
+				if err == nil {
+					parts[n-1] = &s3.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: aws.Int64(n)}
+				}
+			}
+			errs <- err
+		}()
+	}
+	for n := int64(1); n <= numParts; n++ {
+		numbers <- n
+	}
+	close(numbers)
+	for i := 0; i < s3manager.DefaultUploadConcurrency; i += 1 {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if err == nil {
+		completeInput := s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(self.bucket),
+			Key:             aws.String(key),
+			UploadId:        uploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		}
+		_, err = self.conn.CompleteMultipartUpload(&completeInput)
+	}
+	if err != nil {
+		abortInput := s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(self.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadId,
+		}
+		self.conn.AbortMultipartUpload(&abortInput)
+	}
+	return err
+}
+
+// uploadParts uploads src in parts, recording each in the journal so an
+// interrupted upload resumes from the last completed part.
+func (self *S3Filesystem) uploadParts(input *s3manager.UploadInput, src File, partSize int64) error {
+	journalKey := self.bucket + "/" + *input.Key
+	uploadId, done, resumable := journal.Upload(journalKey, src, partSize)
+	exists := uploadId != ""
+	if resumable {
+		// check the upload can still be resumed
+		listPartsInput := s3.ListPartsInput{
+			Bucket:   input.Bucket,
+			Key:      input.Key,
+			UploadId: aws.String(uploadId),
+		}
+		_, err := self.conn.ListParts(&listPartsInput)
+		if retryable(err) {
+			return err
+		}
+		resumable = err == nil
+		exists = !noSuchUpload(err)
+	}
+	if uploadId != "" && !resumable {
+		// abort the stale upload, so its parts don't keep incurring storage
+		if exists {
+			err := self.abortUpload(*input.Key, uploadId)
+			if retryable(err) {
+				return err
+			} else if err != nil {
+				warn("couldn't abort upload of %s: %s", journalKey, err)
+			}
+		}
+		err := journal.AbortedUpload(journalKey, uploadId)
+		if err != nil {
+			return err
+		}
+		uploadId = ""
+	}
+	if uploadId == "" {
+		createInput := s3.CreateMultipartUploadInput{
+			ACL:                input.ACL,
+			Bucket:             input.Bucket,
+			Key:                input.Key,
+			CacheControl:       input.CacheControl,
+			ContentDisposition: input.ContentDisposition,
+			ContentEncoding:    input.ContentEncoding,
+			ContentLanguage:    input.ContentLanguage,
+			ContentType:        input.ContentType,
+			Expires:            input.Expires,
+			Metadata:           input.Metadata,
+			StorageClass:       input.StorageClass,
 		}
-		output, err := self.conn.GetObject(&getObjectInput)
+		output, err := self.conn.CreateMultipartUpload(&createInput)
 		if err != nil {
 			return err
 		}
-		defer output.Body.Close()
-		input.Body = output.Body
-		// transfer existing headers across
-		input.ContentType = output.ContentType
-		// input.LastModified = output.LastModified
-		input.StorageClass = output.StorageClass
-	default:
-		reader, err := src.Reader()
+		uploadId = *output.UploadId
+		done = map[int64]string{}
+		err = journal.StartUpload(journalKey, uploadId, src, partSize)
 		if err != nil {
 			return err
 		}
-		input.Body = reader
-		defer reader.Close()
-		input.ContentType = aws.String(guessMimeType(src.Relative()))
 	}
 
-	u := s3manager.NewUploaderWithClient(self.conn)
-	_, err := u.Upload(&input)
+	// as many parts are uploaded at once as by the uploader, each worker
+	// reading its next part from the body into its own buffer
+	size := src.Size()
+	parts := make([]*s3.CompletedPart, (size+partSize-1)/partSize)
+	var lock sync.Mutex
+	var err error
+	next := int64(1)
+	var wg sync.WaitGroup
+	for i := 0; i < s3manager.DefaultUploadConcurrency; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf []byte
+			for {
+				lock.Lock()
+				if err != nil || next > int64(len(parts)) {
+					lock.Unlock()
+					return
+				}
+				n := next
+				next += 1
+				length := size - (n-1)*partSize
+				if length > partSize {
+					length = partSize
+				}
+				if etag, ok := done[n]; ok {
+					err = skip(input.Body, length)
+					parts[n-1] = &s3.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int64(n)}
+					lock.Unlock()
+					continue
+				}
+				if buf == nil {
+					buf = make([]byte, partSize)
+				}
+				_, err = io.ReadFull(input.Body, buf[:length])
+				failed := err != nil
+				lock.Unlock()
+				if failed {
+					return
+				}
+
+				uploadPartInput := s3.UploadPartInput{
+					Bucket:     input.Bucket,
+					Key:        input.Key,
+					UploadId:   aws.String(uploadId),
+					PartNumber: aws.Int64(n),
+					Body:       bytes.NewReader(buf[:length]),
+				}
+				output, e := self.conn.UploadPart(&uploadPartInput)
+				if e == nil {
+					parts[n-1] = &s3.CompletedPart{ETag: output.ETag, PartNumber: aws.Int64(n)}
+					e = journal.UploadedPart(journalKey, uploadId, n, *output.ETag)
+				}
+				if e != nil {
+					lock.Lock()
+					if err == nil {
+						err = e
+					}
+					lock.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	completeInput := s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}
+	_, err = self.conn.CompleteMultipartUpload(&completeInput)
+	if err != nil {
+		return err
+	}
+	return journal.CompletedUpload(journalKey, uploadId)
+}
+
+// abortUpload aborts a multipart upload to key, unless already gone.
+func (self *S3Filesystem) abortUpload(key, uploadId string) error {
+	input := s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(self.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}
+	_, err := self.conn.AbortMultipartUpload(&input)
+	if noSuchUpload(err) {
+		return nil
+	}
+	return err
+}
+
+// noSuchUpload returns whether err is for an upload that doesn't exist,
+// such as one completed, aborted or expired.
+func noSuchUpload(err error) bool {
+	e, ok := err.(awserr.Error)
+	return ok && e.Code() == "NoSuchUpload"
+}
+
+// skip discards n bytes from reader, seeking if possible.
+func skip(reader io.Reader, n int64) error {
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, reader, n)
 	return err
 }
 
@@ -171,6 +720,8 @@ func (self *S3Filesystem) Delete(path string) error {
 		Bucket: aws.String(self.bucket),
 		Key:    aws.String(fullpath),
 	}
-	_, err := self.conn.DeleteObject(&input)
-	return err
+	return withRetry(func() error {
+		_, err := self.conn.DeleteObject(&input)
+		return err
+	})
 }
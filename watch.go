@@ -0,0 +1,133 @@
+package s3
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// watchSync syncs a local src to dest, then keeps it in sync by pushing
+// changed paths as they are notified. A full sync is rerun every
+// watchInterval to catch any missed events.
+func watchSync(conn s3iface.S3API, src, dest string) error {
+	if isS3Url(src) {
+		return errors.New("--watch requires a local source")
+	}
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		return errors.New("--watch requires a source directory")
+	}
+	cmp, err := getComparator()
+	if err != nil {
+		return err
+	}
+
+	// start watching before the initial sync so no changes are missed
+	events, err := watchFiles(src)
+	if err != nil {
+		return err
+	}
+	err = syncFiles(conn, src, dest)
+	if err != nil {
+		return err
+	}
+	return watchBatches(events, func(changed map[string]bool) error {
+		return syncChanged(conn, src, dest, changed, cmp)
+	}, func() error {
+		return syncFiles(conn, src, dest)
+	})
+}
+
+// watchFiles sends the paths beneath root that change, and is replaced in
+// tests.
+var watchFiles = notifyChanges
+
+// watchBatches collects the changed paths sent on events, handling them
+// together once they settle for watchDelay, and resyncs every
+// watchInterval. Any changes pending when events ends are handled before
+// returning.
+func watchBatches(events <-chan string, handle func(changed map[string]bool) error, resync func() error) error {
+	reconcile := time.NewTicker(watchInterval)
+	defer reconcile.Stop()
+	changed := map[string]bool{}
+	var flush <-chan time.Time
+	for {
+		select {
+		case path, ok := <-events:
+			if !ok {
+				if len(changed) > 0 {
+					if err := handle(changed); err != nil {
+						printError(err)
+					}
+				}
+				return errors.New("watch stopped")
+			}
+			changed[path] = true
+			// debounce until changes settle
+			flush = time.After(watchDelay)
+		case <-flush:
+			err := handle(changed)
+			if err != nil {
+				printError(err)
+			}
+			changed = map[string]bool{}
+			flush = nil
+		case <-reconcile.C:
+			err := resync()
+			if err != nil {
+				printError(err)
+			}
+			changed = map[string]bool{}
+			flush = nil
+		}
+	}
+}
+
+// syncChanged syncs just the changed paths, including all files beneath
+// any changed directories.
+func syncChanged(conn s3iface.S3API, src, dest string, changed map[string]bool, cmp Comparator) error {
+	fs1 := getFilesystem(conn, src).(*LocalFilesystem)
+	fs2 := sideFilesystem(conn, destSettings, dest)
+	var paths []string
+	for path := range changed {
+		paths = append(paths, filepath.Clean(path))
+	}
+	sort.Strings(paths)
+	destTotal := 0
+	if maxDeletePercent < 100 {
+		// the percentage is of the whole destination, not just the changes
+		for range filterFiles(fs2.Files()) {
+			destTotal += 1
+		}
+		if err := fs2.Error(); err != nil {
+			return err
+		}
+	}
+	for i, path := range paths {
+		// skip paths covered by a changed parent directory
+		if i > 0 && strings.HasPrefix(path, paths[i-1]+string(os.PathSeparator)) {
+			paths[i] = paths[i-1]
+			continue
+		}
+		relpath, err := fs1.relative(path)
+		if err != nil {
+			return err
+		}
+		ch1, ch2 := fs1.Files(), fs2.Files()
+		if relpath != "." {
+			ch1, ch2 = fs1.FilesUnder(relpath), fs2.FilesUnder(relpath)
+		}
+		counts, err := syncLists(fs1, fs2, ch1, ch2, cmp, destTotal)
+		if err == nil {
+			err = counts.failures()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyWatcher watches a directory tree, adding watches for directories
+// as they are created.
+type inotifyWatcher struct {
+	fd   int
+	root string
+	dirs map[int32]string
+	ch   chan string
+}
+
+// notifyChanges sends the paths beneath root that are created, modified,
+// moved or deleted.
+func notifyChanges(root string) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{fd: fd, root: root, dirs: map[int32]string{}, ch: make(chan string, 1000)}
+	err = w.addTree(root)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	go w.run()
+	return w.ch, nil
+}
+
+func (self *inotifyWatcher) addTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(self.fd, path, watchMask)
+		if err != nil {
+			return err
+		}
+		self.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+func (self *inotifyWatcher) run() {
+	defer close(self.ch)
+	defer syscall.Close(self.fd)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(self.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			offset = nameEnd
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// events were lost, resync everything
+				self.ch <- self.root
+				continue
+			}
+			dir, ok := self.dirs[event.Wd]
+			if !ok {
+				continue
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(self.dirs, event.Wd)
+				continue
+			}
+			name := string(buf[nameStart:nameEnd])
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			if name == "" {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				// errors here are caught by the periodic resync
+				self.addTree(path)
+			}
+			self.ch <- path
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package s3
+
+import "fmt"
+
+// notifyChanges is unsupported without inotify, leaving only the periodic
+// full sync.
+func notifyChanges(root string) (<-chan string, error) {
+	fmt.Fprintf(err, "Change notifications unsupported, syncing every %s\n", watchInterval)
+	return make(chan string), nil
+}